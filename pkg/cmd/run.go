@@ -1,20 +1,52 @@
 package cmd
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/queue"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/replay"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/resync"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/secrets"
 	"github.com/garethjevans/pr-controller/pkg/prcontroller/server"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/status"
 
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+// setupRetryInterval is how often starting the workload cache is retried after it fails.
+const setupRetryInterval = 30 * time.Second
+
 var (
-	BindAddress string
-	Port        int
+	BindAddress  string
+	Port         int
+	MetricsPort  int
+	ReportStatus bool
+	Comment      bool
+	Drivers      []string
+	SecretFiles  = map[string]*string{}
+
+	RepositorySecrets bool
+
+	ReplayWindow    time.Duration
+	ReplayConfigMap string
+
+	TombstoneConfigMap string
+
+	Workers    int
+	MaxRetries int
+
+	ResyncInterval time.Duration
+	ResyncDryRun   bool
 )
 
 // NewRunCmd creates a new run command.
@@ -26,20 +58,71 @@ func NewRunCmd() *cobra.Command {
 		Example: "pr-controller run",
 		Aliases: []string{"r"},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			mux := http.NewServeMux()
+			// resyncs are queued with the webhooks
+			if Workers > 0 {
+				server.Queue = queue.New(queue.Handle, MaxRetries)
+				server.Queue.Start(context.Background(), Workers)
+			}
+
+			// everything watching the workload cache starts once it has started
+			handler.OnSetup(func() {
+				if ReportStatus {
+					status.NewReporter(handler.Cache).Start(context.Background(), status.DefaultWorkers)
+				}
+				if Comment {
+					status.NewCommenter(handler.Cache).Start(context.Background(), status.DefaultWorkers)
+				}
+				if ResyncInterval > 0 {
+					resync.New(handler.Cache, handler.Dynamic, server.Queue, ResyncInterval, ResyncDryRun).Start(context.Background())
+				}
+			})
 
-			gh, err := server.NewWebHook("github")
-			if err != nil {
-				return err
+			// webhooks are rejected until the repository secrets are loaded, rather than verified with the
+			// secrets of the driver
+			if RepositorySecrets {
+				namespace := secrets.Namespace()
+				if namespace == "" {
+					return fmt.Errorf("unable to determine the controller namespace for repository secrets, set POD_NAMESPACE or remove --repository-secrets")
+				}
+				server.RequireRepositorySecrets(true)
+				go startRepositorySecrets(context.Background(), namespace)
 			}
 
-			mux.HandleFunc("/github", gh.Handle)
+			if ReplayWindow > 0 {
+				store, err := deliveries()
+				if err != nil {
+					return err
+				}
+				server.Deliveries = store
+			}
+
+			// the resync started once the workload cache has started deletes resources, so the tombstones
+			// must be shared before it starts
+			if TombstoneConfigMap != "" {
+				store, err := tombstones()
+				if err != nil {
+					return err
+				}
+				handler.Tombstones = store
+			}
+
+			// warm the workload cache in the background, so the server listens even if it cannot start. It is
+			// retried until it succeeds, or when a webhook is received.
+			go setup(context.Background())
+
+			mux := http.NewServeMux()
 
-			gl, err := server.NewWebHook("gitlab")
-			if err != nil {
-				return err
+			for _, driver := range Drivers {
+				var secretFile string
+				if f, ok := SecretFiles[driver]; ok {
+					secretFile = *f
+				}
+				wh, err := server.NewWebHook(driver, secretFile)
+				if err != nil {
+					return err
+				}
+				mux.HandleFunc("/"+driver, wh.Handle)
 			}
-			mux.HandleFunc("/gitlab", gl.Handle)
 
 			mux.HandleFunc("/ready", func(writer http.ResponseWriter, request *http.Request) {
 				fmt.Fprintln(writer, "ok (ready) handler")
@@ -58,6 +141,12 @@ func NewRunCmd() *cobra.Command {
 				Handler:           mux,
 			}
 
+			// counts of the webhooks verified with each secret are served separately, as expvar also
+			// publishes the command line and memory statistics
+			if MetricsPort > 0 {
+				go serveMetrics(fmt.Sprintf("%s:%d", BindAddress, MetricsPort))
+			}
+
 			logrus.Infof("Starting...")
 
 			return s.ListenAndServe()
@@ -68,6 +157,105 @@ func NewRunCmd() *cobra.Command {
 
 	cmd.Flags().StringVarP(&BindAddress, "bind-address", "", "localhost", "The address to bind to (default: localhost)")
 	cmd.Flags().IntVarP(&Port, "port", "p", 8080, "The port to run the webserver on (default: 8080)")
+	cmd.Flags().IntVarP(&MetricsPort, "metrics-port", "", 0, "The port to serve /debug/vars on, separately from the webhooks, 0 disables (default: 0)")
+	cmd.Flags().BoolVarP(&ReportStatus, "report-status", "", true, "Report the status of pull request resources as commit statuses, requires <DRIVER>_TOKEN (default: true)")
+	cmd.Flags().DurationVarP(&ResyncInterval, "resync-interval", "", 10*time.Minute, "How often to reconcile pull request resources against the SCM, 0 disables (default: 10m)")
+	cmd.Flags().BoolVarP(&ResyncDryRun, "resync-dry-run", "", false, "Only log the changes a resync would make (default: false)")
+	cmd.Flags().StringSliceVarP(&Drivers, "drivers", "", []string{"github", "gitlab"}, fmt.Sprintf("The drivers to receive webhooks from at /<driver>, each verified with <DRIVER>_SHARED_SECRET, or with any of the secrets in <DRIVER>_SHARED_SECRETS one per line, one of %s (default: github,gitlab)", strings.Join(server.Drivers, ", ")))
+	cmd.Flags().BoolVarP(&Comment, "comment", "", true, "Maintain a summary comment on each pull request, requires <DRIVER>_TOKEN (default: true)")
+	cmd.Flags().BoolVarP(&RepositorySecrets, "repository-secrets", "", false, "Verify webhooks with the shared secrets in Secrets labelled pr-controller/repo in the controller namespace, requires POD_NAMESPACE and webhooks are rejected until the Secrets are loaded (default: false)")
+	cmd.Flags().DurationVarP(&ReplayWindow, "replay-window", "", time.Hour, "How long to remember deliveries for, replayed deliveries are rejected, 0 disables (default: 1h)")
+	cmd.Flags().StringVarP(&ReplayConfigMap, "replay-configmap", "", "", "A ConfigMap in the controller namespace to remember deliveries in, so they survive restarts and are shared by replicas (default: in memory)")
+	cmd.Flags().StringVarP(&TombstoneConfigMap, "tombstone-configmap", "", "", "A ConfigMap in the controller namespace to remember deleted pull request resources in, so late events don't recreate them after a restart or on another replica (default: in memory)")
+	cmd.Flags().IntVarP(&Workers, "workers", "", 4, "The number of workers handling queued pull request webhooks, 0 handles them before responding (default: 4)")
+	cmd.Flags().IntVarP(&MaxRetries, "max-retries", "", queue.DefaultMaxRetries, "How many times a queued pull request webhook that failed is retried, backing off from 1s to 5m (default: 12)")
+	for _, driver := range server.Drivers {
+		SecretFiles[driver] = cmd.Flags().StringP(driver+"-secret-file", "", "", fmt.Sprintf("A file containing the %s shared secrets, one per line, re-read when it changes, overrides %s_SHARED_SECRET", driver, strings.ToUpper(driver)))
+	}
 
 	return cmd
 }
+
+// setup starts the workload cache, retrying until it starts or the context is done.
+func setup(ctx context.Context) {
+	_ = wait.PollUntilContextCancel(ctx, setupRetryInterval, true, func(context.Context) (bool, error) {
+		if err := handler.Setup(); err != nil {
+			logrus.Warnf("unable to start the workload cache, retrying: %v", err)
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+// serveMetrics serves the published variables, including the counts of the webhooks verified with
+// each secret, at /debug/vars.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	s := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           mux,
+	}
+
+	logrus.Infof("serving metrics on %s", addr)
+	if err := s.ListenAndServe(); err != nil {
+		logrus.Errorf("unable to serve metrics: %v", err)
+	}
+}
+
+// startRepositorySecrets watches the Secrets containing the shared secrets of individual repositories,
+// retrying until they are loaded or the context is done.
+func startRepositorySecrets(ctx context.Context, namespace string) {
+	var store *secrets.Store
+	_ = wait.PollUntilContextCancel(ctx, setupRetryInterval, true, func(context.Context) (bool, error) {
+		if store == nil {
+			if err := handler.Clients(); err != nil {
+				logrus.Warnf("unable to watch repository secrets in %s, rejecting webhooks until they are loaded: %v", namespace, err)
+				return false, nil
+			}
+			store = secrets.New(handler.Dynamic, namespace, 10*time.Minute)
+		}
+		if err := store.Start(ctx); err != nil {
+			logrus.Warnf("unable to load repository secrets in %s, rejecting webhooks until they are loaded: %v", namespace, err)
+			return false, nil
+		}
+		logrus.Infof("loaded repository secrets in %s", namespace)
+		server.SetRepositorySecrets(store)
+		return true, nil
+	})
+}
+
+// deliveries creates the store of recently received deliveries, failing if the configmap to remember
+// them in cannot be used rather than only remembering them on this replica.
+func deliveries() (replay.Store, error) {
+	if ReplayConfigMap == "" {
+		logrus.Infof("remembering deliveries for %s", ReplayWindow)
+		return replay.NewMemory(ReplayWindow, replay.DefaultMaxEntries), nil
+	}
+
+	namespace := secrets.Namespace()
+	if namespace == "" {
+		return nil, fmt.Errorf("unable to determine the controller namespace for configmap %s, set POD_NAMESPACE", ReplayConfigMap)
+	}
+	if err := handler.Clients(); err != nil {
+		return nil, fmt.Errorf("unable to use configmap %s to remember deliveries: %w", ReplayConfigMap, err)
+	}
+	logrus.Infof("remembering deliveries for %s in configmap %s/%s", ReplayWindow, namespace, ReplayConfigMap)
+	return replay.NewConfigMap(handler.Dynamic, namespace, ReplayConfigMap, ReplayWindow, replay.DefaultConfigMapMaxEntries), nil
+}
+
+// tombstones creates the store of deleted pull request resources in the configmap, failing if it cannot
+// be used rather than only remembering them on this replica.
+func tombstones() (handler.TombstoneStore, error) {
+	namespace := secrets.Namespace()
+	if namespace == "" {
+		return nil, fmt.Errorf("unable to determine the controller namespace for configmap %s, set POD_NAMESPACE", TombstoneConfigMap)
+	}
+	if err := handler.Clients(); err != nil {
+		return nil, fmt.Errorf("unable to use configmap %s to remember deleted resources: %w", TombstoneConfigMap, err)
+	}
+	logrus.Infof("remembering deleted resources for %s in configmap %s/%s", handler.DefaultTombstoneTTL, namespace, TombstoneConfigMap)
+	return handler.NewConfigMapTombstones(handler.Dynamic, namespace, TombstoneConfigMap, handler.DefaultTombstoneTTL, configmap.DefaultMaxEntries), nil
+}
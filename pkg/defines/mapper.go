@@ -0,0 +1,62 @@
+package defines
+
+import (
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+)
+
+// Mapper resolves kinds to their resources using the discovery API. Discovery
+// results are cached and refreshed whenever a kind cannot be found, so newly
+// installed CRDs are picked up without a restart.
+type Mapper struct {
+	cache  *staleCache
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+}
+
+// NewMapper creates a Mapper backed by a cached copy of the discovery client.
+func NewMapper(d discovery.DiscoveryInterface) *Mapper {
+	c := &staleCache{CachedDiscoveryInterface: memory.NewMemCacheClient(d)}
+	return &Mapper{
+		cache:  c,
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(c),
+	}
+}
+
+// ResourceFor resolves the plural resource for the given kind.
+func (m *Mapper) ResourceFor(gvk schema.GroupVersionKind) (GroupVersionResourceKind, error) {
+	// the mapper refreshes a stale cache and tries again if the kind cannot be found
+	m.cache.stale.Store(true)
+	mapping, err := m.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return GroupVersionResourceKind{}, err
+	}
+
+	return GroupVersionResourceKind{
+		Group:    mapping.Resource.Group,
+		Version:  mapping.Resource.Version,
+		Resource: mapping.Resource.Resource,
+		Kind:     mapping.GroupVersionKind.Kind,
+	}, nil
+}
+
+// staleCache is a discovery cache that is stale until it is refreshed. The memory cache is fresh once it
+// has been populated, so the mapper would never refresh it to find kinds installed since.
+type staleCache struct {
+	discovery.CachedDiscoveryInterface
+	stale atomic.Bool
+}
+
+// Fresh returns true if the cache has been refreshed since it was last marked stale.
+func (c *staleCache) Fresh() bool {
+	return !c.stale.Load()
+}
+
+// Invalidate refreshes the cache.
+func (c *staleCache) Invalidate() {
+	c.stale.Store(false)
+	c.CachedDiscoveryInterface.Invalidate()
+}
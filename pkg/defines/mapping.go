@@ -0,0 +1,243 @@
+package defines
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// PullRequestMappingGVK is the kind of the namespaced mappings, which apply to base resources in
+	// their own namespace.
+	PullRequestMappingGVK = schema.GroupVersionKind{Group: "pr.apps.tanzu.vmware.com", Version: "v1alpha1", Kind: "PullRequestMapping"}
+
+	// ClusterPullRequestMappingGVK is the kind of the cluster scoped mappings, which apply to base
+	// resources in every namespace.
+	ClusterPullRequestMappingGVK = schema.GroupVersionKind{Group: "pr.apps.tanzu.vmware.com", Version: "v1alpha1", Kind: "ClusterPullRequestMapping"}
+)
+
+// Mapping pairs a base kind with the pull request kind created for it, and templates the pull request
+// resources. It is read from a PullRequestMapping or ClusterPullRequestMapping.
+type Mapping struct {
+	// Namespace is the namespace the mapping applies to, or empty if it applies to every namespace.
+	Namespace   string
+	Name        string
+	Base        GroupVersionResourceKind
+	PullRequest GroupVersionResourceKind
+	Template    *template.Template
+}
+
+// TemplateContext is the data the template of a Mapping is rendered with. The pull request fields are
+// chosen by its author and the template is rendered before the yaml is parsed, so they are Quoted.
+type TemplateContext struct {
+	PullRequest PullRequestContext
+	// Base is the base resource the pull request resource is created from.
+	Base map[string]interface{}
+}
+
+// PullRequestContext describes the pull request a resource is created for.
+type PullRequestContext struct {
+	Number     int
+	Title      Quoted
+	URL        Quoted
+	Author     Quoted
+	Labels     []Quoted
+	HeadRef    Quoted
+	BaseRef    Quoted
+	Sha        Quoted
+	Repository Quoted
+	CloneURL   Quoted
+}
+
+// Quoted is a string chosen by the author of a pull request. It is rendered as a quoted string, so
+// that it cannot add or change the fields of the rendered yaml, and the template functions that
+// transform it return Quoted strings.
+type Quoted string
+
+// String returns the string quoted as json, which is also a valid yaml string.
+func (q Quoted) String() string {
+	b, _ := json.Marshal(string(q))
+	return string(b)
+}
+
+// Strings returns the strings as Quoted strings.
+func Strings(s []string) []Quoted {
+	q := make([]Quoted, 0, len(s))
+	for _, v := range s {
+		q = append(q, Quoted(v))
+	}
+	return q
+}
+
+// MappingFor reads a Mapping from a PullRequestMapping or ClusterPullRequestMapping, resolving the
+// base and pull request kinds (spec.base and spec.pullRequest) and parsing spec.template.
+func MappingFor(u unstructured.Unstructured, mapper *Mapper) (Mapping, error) {
+	base, err := mappingKind(u, mapper, "base")
+	if err != nil {
+		return Mapping{}, err
+	}
+	pr, err := mappingKind(u, mapper, "pullRequest")
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	text, _, _ := unstructured.NestedString(u.Object, "spec", "template")
+	t, err := template.New(u.GetName()).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("unable to parse the template of mapping %s: %w", u.GetName(), err)
+	}
+
+	return Mapping{
+		Namespace:   u.GetNamespace(),
+		Name:        u.GetName(),
+		Base:        base,
+		PullRequest: pr,
+		Template:    t,
+	}, nil
+}
+
+func mappingKind(u unstructured.Unstructured, mapper *Mapper, field string) (GroupVersionResourceKind, error) {
+	apiVersion, _, _ := unstructured.NestedString(u.Object, "spec", field, "apiVersion")
+	kind, _, _ := unstructured.NestedString(u.Object, "spec", field, "kind")
+	if kind == "" {
+		return GroupVersionResourceKind{}, fmt.Errorf("mapping %s does not define spec.%s.kind", u.GetName(), field)
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return GroupVersionResourceKind{}, err
+	}
+	return mapper.ResourceFor(gv.WithKind(kind))
+}
+
+// Render renders the template with the context, returning the fields it sets.
+func (m Mapping) Render(ctx TemplateContext) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := m.Template.Execute(&buf, ctx); err != nil {
+		return nil, fmt.Errorf("unable to render the template of mapping %s: %w", m.Name, err)
+	}
+
+	b, err := yaml.YAMLToJSON(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("the template of mapping %s is not valid yaml: %w", m.Name, err)
+	}
+
+	// numbers are decoded as int64 or float64, as they are in unstructured objects
+	fields := map[string]interface{}{}
+	if err := utiljson.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("the template of mapping %s does not render an object: %w", m.Name, err)
+	}
+	return fields, nil
+}
+
+// Merge sets the fields in src on dst, merging nested objects.
+func Merge(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		if s, ok := v.(map[string]interface{}); ok {
+			if d, ok := dst[k].(map[string]interface{}); ok {
+				Merge(d, s)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	"lower":      func(v interface{}) interface{} { return transform(v, strings.ToLower) },
+	"upper":      func(v interface{}) interface{} { return transform(v, strings.ToUpper) },
+	"labelValue": func(v interface{}) interface{} { return transform(v, LabelValue) },
+	"replace": func(old string, new string, v interface{}) interface{} {
+		return transform(v, func(s string) string { return strings.ReplaceAll(s, old, new) })
+	},
+	"trunc": func(n int, v interface{}) interface{} {
+		return transform(v, func(s string) string {
+			// truncate by runes, so that multi-byte characters are not split
+			if r := []rune(s); len(r) > n {
+				return string(r[:n])
+			}
+			return s
+		})
+	},
+	"join": func(sep string, v interface{}) interface{} {
+		values, quoted := texts(v)
+		return result(strings.Join(values, sep), quoted)
+	},
+	// concat joins strings, e.g. to build a name from the head ref, which is Quoted if any of them are
+	"concat": func(v ...interface{}) interface{} {
+		values, quoted := texts(v)
+		return result(strings.Join(values, ""), quoted)
+	},
+	"has": func(v interface{}, s string) bool {
+		values, _ := texts(v)
+		for _, i := range values {
+			if i == s {
+				return true
+			}
+		}
+		return false
+	},
+	"toJson": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// text returns the unquoted string of a value, and whether it was Quoted.
+func text(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case Quoted:
+		return string(v), true
+	case string:
+		return v, false
+	default:
+		return fmt.Sprint(v), false
+	}
+}
+
+// texts returns the unquoted strings of a slice of values, and whether any of them were Quoted.
+func texts(v interface{}) ([]string, bool) {
+	var items []interface{}
+	switch v := v.(type) {
+	case []Quoted:
+		for _, i := range v {
+			items = append(items, i)
+		}
+	case []string:
+		for _, i := range v {
+			items = append(items, i)
+		}
+	case []interface{}:
+		items = v
+	default:
+		items = []interface{}{v}
+	}
+
+	values := make([]string, 0, len(items))
+	quoted := false
+	for _, i := range items {
+		s, q := text(i)
+		values = append(values, s)
+		quoted = quoted || q
+	}
+	return values, quoted
+}
+
+// transform applies f to the unquoted string of a value, keeping it Quoted if it was.
+func transform(v interface{}, f func(string) string) interface{} {
+	s, quoted := text(v)
+	return result(f(s), quoted)
+}
+
+func result(s string, quoted bool) interface{} {
+	if quoted {
+		return Quoted(s)
+	}
+	return s
+}
@@ -0,0 +1,168 @@
+package defines_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func mapping(template string) unstructured.Unstructured {
+	return unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pr.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "PullRequestMapping",
+		"metadata": map[string]interface{}{
+			"name":      "examples",
+			"namespace": "my-namespace",
+		},
+		"spec": map[string]interface{}{
+			"base":        map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Example"},
+			"pullRequest": map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Preview"},
+			"template":    template,
+		},
+	}}
+}
+
+func TestMapping(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+				{Name: "previews", SingularName: "preview", Namespaced: true, Kind: "Preview"},
+			},
+		},
+	}
+	mapper := defines.NewMapper(fakeDiscovery)
+
+	ctx := defines.TemplateContext{
+		PullRequest: defines.PullRequestContext{
+			Number:  416,
+			Title:   "Add a feature",
+			Author:  "octocat",
+			Labels:  defines.Strings([]string{"preview", "tests"}),
+			HeadRef: "feature/thing",
+			Sha:     "abc123",
+		},
+		Base: map[string]interface{}{
+			"spec": map[string]interface{}{"replicas": int64(2)},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		template  string
+		want      map[string]interface{}
+		wantError bool
+	}{
+		{
+			name: "renders the pull request context",
+			template: `metadata:
+  labels:
+    branch: {{ labelValue .PullRequest.HeadRef }}
+spec:
+  title: {{ toJson .PullRequest.Title }}
+  number: {{ .PullRequest.Number }}
+  author: {{ .PullRequest.Author | upper }}
+  replicas: {{ .Base.spec.replicas }}
+  {{- if has .PullRequest.Labels "tests" }}
+  tests: enabled
+  {{- end }}
+`,
+			want: map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]interface{}{"branch": "feature-thing"}},
+				"spec": map[string]interface{}{
+					"title":    "Add a feature",
+					"number":   int64(416),
+					"author":   "OCTOCAT",
+					"replicas": int64(2),
+					"tests":    "enabled",
+				},
+			},
+		},
+		{
+			name: "quotes the pull request fields",
+			template: `spec:
+  title: {{ .PullRequest.Title }}
+  branch: {{ .PullRequest.HeadRef | replace "/" "-" | trunc 7 }}
+  name: {{ concat "preview-" .PullRequest.Number "-" (lower .PullRequest.Author) }}
+  labels: {{ join "," .PullRequest.Labels }}
+  emoji: {{ trunc 2 "🚀🚀🚀" }}
+`,
+			want: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"title":  "Add a feature",
+					"branch": "feature",
+					"name":   "preview-416-octocat",
+					"labels": "preview,tests",
+					"emoji":  "🚀🚀",
+				},
+			},
+		},
+		{
+			name:      "invalid yaml",
+			template:  "spec: [",
+			wantError: true,
+		},
+		{
+			name:      "execution error",
+			template:  "{{ .PullRequest.Missing }}",
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := defines.MappingFor(mapping(tt.template), mapper)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Base.Resource != "examples" || m.PullRequest.Resource != "previews" || m.Namespace != "my-namespace" {
+				t.Errorf("MappingFor() = %+v", m)
+			}
+
+			got, err := m.Render(ctx)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("Render() error = %v, wantError %v", err, tt.wantError)
+			}
+			if !tt.wantError && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Render() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dst := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "go-scm-pr-416"},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm"}},
+			"params": []interface{}{"a"},
+		},
+	}
+	defines.Merge(dst, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"subPath": "app"},
+			"params": []interface{}{"b"},
+		},
+	})
+
+	want := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "go-scm-pr-416"},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm"}, "subPath": "app"},
+			"params": []interface{}{"b"},
+		},
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("Merge() = %v, want %v", dst, want)
+	}
+}
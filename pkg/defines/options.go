@@ -0,0 +1,88 @@
+package defines
+
+import (
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// StatusContextAnnotation is the annotation on a SupplyChain that sets the context of the commit
+	// statuses reported for the kind it defines.
+	StatusContextAnnotation = "pr-controller/status-context"
+
+	// OwnerReferencesAnnotation is the annotation on a SupplyChain that, when set to false, stops pull
+	// request resources from being owned by their base resource.
+	OwnerReferencesAnnotation = "pr-controller/owner-references"
+
+	// SpecIncludeAnnotation is the annotation on a SupplyChain listing the comma separated spec paths
+	// copied from the base resource to the pull request resources of the kind it defines.
+	SpecIncludeAnnotation = "pr-controller/spec-include"
+
+	// SpecExcludeAnnotation is the annotation on a SupplyChain listing the comma separated spec paths
+	// that are not copied from the base resource.
+	SpecExcludeAnnotation = "pr-controller/spec-exclude"
+
+	// SourceLayoutAnnotation is the annotation on a SupplyChain naming the layout of the git source of
+	// the kind it defines, one of git, git-ref or flux. The layout is detected if it is not set.
+	SourceLayoutAnnotation = "pr-controller/source-layout"
+
+	// CopyLabelsAnnotation is the annotation on a SupplyChain listing the comma separated label keys,
+	// or prefixes ending in a slash, copied from the base resource. No labels are copied if it is not set.
+	CopyLabelsAnnotation = "pr-controller/copy-labels"
+
+	// CopyAnnotationsAnnotation is the annotation on a SupplyChain listing the comma separated annotation
+	// keys, or prefixes ending in a slash, copied from the base resource. No annotations are copied if it
+	// is not set.
+	CopyAnnotationsAnnotation = "pr-controller/copy-annotations"
+)
+
+// Options configure how pull requests are handled for the kind defined by a SupplyChain. They are
+// set with annotations on the SupplyChain.
+type Options struct {
+	// StatusContext is the context (or name) of the commit statuses reported to the SCM.
+	StatusContext string
+	// DisableOwnerReferences stops pull request resources being garbage collected with their base resource.
+	DisableOwnerReferences bool
+	// SpecInclude are the spec paths copied from the base resource, all of the spec is copied if empty.
+	SpecInclude []string
+	// SpecExclude are the spec paths that are not copied from the base resource.
+	SpecExclude []string
+	// SourceLayout is the name of the layout of the git source, see SourceLayoutFor.
+	SourceLayout string
+	// CopyLabels are the label keys, or prefixes, copied from the base resource.
+	CopyLabels []string
+	// CopyAnnotations are the annotation keys, or prefixes, copied from the base resource.
+	CopyAnnotations []string
+}
+
+// Source returns the layout of the git source.
+func (o Options) Source() SourceLayout {
+	return SourceLayoutFor(o.SourceLayout)
+}
+
+// OptionsFor reads the Options from the annotations on a SupplyChain.
+func OptionsFor(chain unstructured.Unstructured) Options {
+	annotations := chain.GetAnnotations()
+	ownerReferences, err := strconv.ParseBool(annotations[OwnerReferencesAnnotation])
+	return Options{
+		StatusContext:          annotations[StatusContextAnnotation],
+		DisableOwnerReferences: err == nil && !ownerReferences,
+		SpecInclude:            split(annotations[SpecIncludeAnnotation]),
+		SpecExclude:            split(annotations[SpecExcludeAnnotation]),
+		SourceLayout:           annotations[SourceLayoutAnnotation],
+		CopyLabels:             split(annotations[CopyLabelsAnnotation]),
+		CopyAnnotations:        split(annotations[CopyAnnotationsAnnotation]),
+	}
+}
+
+func split(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,72 @@
+package defines
+
+import (
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// PathsAnnotation is the annotation on a base resource listing the comma separated globs of the paths
+// it is built from, e.g. apps/api/**,libs/**. Pull request resources are only created for it when the
+// pull request changes a matching file. If it is not set, the subPath of the source is used.
+const PathsAnnotation = "pr-controller/paths"
+
+// Paths returns the globs of the paths a base resource is built from, or nil if it is built from the
+// whole repository.
+func Paths(base *unstructured.Unstructured, source Source) []string {
+	if globs := split(base.GetAnnotations()[PathsAnnotation]); len(globs) > 0 {
+		return globs
+	}
+	if subPath := strings.Trim(source.SubPath, "/"); subPath != "" && subPath != "." {
+		return []string{subPath + "/**"}
+	}
+	return nil
+}
+
+// MatchesPaths returns true if any of the files match any of the globs. Globs match * within a path
+// segment, ** across segments and ? for a single character.
+func MatchesPaths(globs []string, files []string) bool {
+	for _, glob := range globs {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if re.MatchString(strings.TrimPrefix(file, "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	glob = strings.TrimPrefix(strings.TrimSpace(glob), "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// **/ matches zero or more directories
+					i++
+					sb.WriteString("(.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
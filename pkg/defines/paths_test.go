@@ -0,0 +1,66 @@
+package defines_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestPaths(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		source      defines.Source
+		want        []string
+	}{
+		{name: "whole repository", want: nil},
+		{name: "root sub path", source: defines.Source{SubPath: "./"}, want: nil},
+		{name: "sub path", source: defines.Source{SubPath: "/apps/api/"}, want: []string{"apps/api/**"}},
+		{
+			name:        "annotation",
+			annotations: map[string]string{defines.PathsAnnotation: "apps/api/**, libs/**"},
+			source:      defines.Source{SubPath: "apps/api"},
+			want:        []string{"apps/api/**", "libs/**"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			base.SetAnnotations(tt.annotations)
+			if got := defines.Paths(base, tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Paths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		globs []string
+		files []string
+		want  bool
+	}{
+		{name: "sub directory", globs: []string{"apps/api/**"}, files: []string{"apps/api/main.go"}, want: true},
+		{name: "nested sub directory", globs: []string{"apps/api/**"}, files: []string{"README.md", "apps/api/pkg/handler/pr.go"}, want: true},
+		{name: "sibling with common prefix", globs: []string{"apps/api/**"}, files: []string{"apps/api-v2/main.go"}, want: false},
+		{name: "other directory", globs: []string{"apps/api/**"}, files: []string{"apps/web/main.go"}, want: false},
+		{name: "single segment", globs: []string{"apps/*/Dockerfile"}, files: []string{"apps/web/Dockerfile"}, want: true},
+		{name: "single segment does not cross directories", globs: []string{"apps/*.go"}, files: []string{"apps/web/main.go"}, want: false},
+		{name: "any directory", globs: []string{"**/*.yaml"}, files: []string{"config/manager/manager.yaml"}, want: true},
+		{name: "any directory includes the root", globs: []string{"**/*.yaml"}, files: []string{"workload.yaml"}, want: true},
+		{name: "single character", globs: []string{"v?/main.go"}, files: []string{"v2/main.go"}, want: true},
+		{name: "meta characters are literal", globs: []string{"docs/(draft).md"}, files: []string{"docs/(draft).md"}, want: true},
+		{name: "leading slash", globs: []string{"/libs/**"}, files: []string{"libs/util.go"}, want: true},
+		{name: "no files", globs: []string{"**"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defines.MatchesPaths(tt.globs, tt.files); got != tt.want {
+				t.Errorf("MatchesPaths(%v, %v) = %t, want %t", tt.globs, tt.files, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package defines
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// PullRequestName is the name of the pull request resource created from a base resource.
+func PullRequestName(base string, number int) string {
+	return fmt.Sprintf("%s-pr-%d", base, number)
+}
+
+// PullRequestNumber parses the pull request number from the name of a pull request resource.
+func PullRequestNumber(name string) (int, bool) {
+	i := strings.LastIndex(name, "-pr-")
+	if i < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(name[i+len("-pr-"):])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Labels and annotations recording the provenance of pull request resources.
+const (
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "pr-controller"
+
+	DriverLabel     = "pr-controller/driver"
+	RepositoryLabel = "pr-controller/repo"
+	NumberLabel     = "pr-controller/number"
+
+	RepositoryAnnotation = "pr-controller/repo"
+	ShaAnnotation        = "pr-controller/sha"
+	AuthorAnnotation     = "pr-controller/author"
+	BaseNameAnnotation   = "pr-controller/base-name"
+	BaseKindAnnotation   = "pr-controller/base-kind"
+	// UpdatedAnnotation is the time the pull request was last updated in the event that was applied,
+	// events for older updates are ignored.
+	UpdatedAnnotation = "pr-controller/updated"
+)
+
+// UpdatedAt returns the time the pull request was last updated in the event applied to a pull request
+// resource.
+func UpdatedAt(obj metav1.Object) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, obj.GetAnnotations()[UpdatedAnnotation])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// FormatUpdated formats the time a pull request was last updated for the UpdatedAnnotation, keeping
+// fractions of a second so that updates in the same second can be ordered.
+func FormatUpdated(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ManagedSelector selects the resources created by the pr-controller.
+var ManagedSelector = labels.SelectorFromSet(labels.Set{ManagedByLabel: ManagedBy})
+
+// IsManaged returns true if the resource was created by the pr-controller.
+func IsManaged(obj metav1.Object) bool {
+	return obj.GetLabels()[ManagedByLabel] == ManagedBy
+}
+
+// PullRequestNumberOf returns the number of the pull request a resource was created for, using the
+// number label if it is set or the name of the resource otherwise.
+func PullRequestNumberOf(obj metav1.Object) (int, bool) {
+	if n, err := strconv.Atoi(obj.GetLabels()[NumberLabel]); err == nil && n > 0 {
+		return n, true
+	}
+	return PullRequestNumber(obj.GetName())
+}
+
+var invalidLabelValue = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// LabelValue converts a string to a valid label value, e.g. org/repo -> org-repo.
+func LabelValue(s string) string {
+	v := invalidLabelValue.ReplaceAllString(s, "-")
+	if len(v) > validation.LabelValueMaxLength {
+		v = v[:validation.LabelValueMaxLength]
+	}
+	return strings.Trim(v, "-_.")
+}
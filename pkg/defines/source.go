@@ -0,0 +1,164 @@
+package defines
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The names of the source layouts, set with the SourceLayoutAnnotation on a SupplyChain.
+const (
+	// SourceLayoutGit reads spec.source.git.url, spec.source.git.branch and spec.source.git.commit.
+	SourceLayoutGit = "git"
+	// SourceLayoutGitRef reads spec.source.git.url and spec.source.git.ref, as used by Cartographer Workloads.
+	SourceLayoutGitRef = "git-ref"
+	// SourceLayoutFlux reads spec.url and spec.ref, as used by Flux GitRepositories.
+	SourceLayoutFlux = "flux"
+)
+
+// Source is the git source of a resource.
+type Source struct {
+	URL     string
+	Branch  string
+	Tag     string
+	Commit  string
+	SubPath string
+}
+
+// SourceLayout reads and writes the git source of resources, which is laid out differently by
+// different kinds.
+type SourceLayout interface {
+	// Read reads the source of a resource.
+	Read(u *unstructured.Unstructured) Source
+	// Write writes the url, branch and commit of the source to a resource, removing any tag.
+	Write(u *unstructured.Unstructured, s Source) error
+	// Fields returns the fields of a resource containing its git source.
+	Fields(u *unstructured.Unstructured) [][]string
+}
+
+// SourceLayoutFor returns the named source layout. If the name is empty or unknown the layout is
+// detected from each resource.
+func SourceLayoutFor(name string) SourceLayout {
+	switch name {
+	case SourceLayoutGit:
+		return gitLayout{}
+	case SourceLayoutGitRef:
+		return gitRefLayout{}
+	case SourceLayoutFlux:
+		return fluxLayout{}
+	default:
+		return detectLayout{}
+	}
+}
+
+// ReadSource reads the source of a resource, detecting its layout.
+func ReadSource(u *unstructured.Unstructured) Source {
+	return detectLayout{}.Read(u)
+}
+
+type gitLayout struct{}
+
+func (gitLayout) Read(u *unstructured.Unstructured) Source {
+	return Source{
+		URL:     str(u, "spec", "source", "git", "url"),
+		Branch:  str(u, "spec", "source", "git", "branch"),
+		Tag:     str(u, "spec", "source", "git", "tag"),
+		Commit:  str(u, "spec", "source", "git", "commit"),
+		SubPath: str(u, "spec", "source", "subPath"),
+	}
+}
+
+func (gitLayout) Write(u *unstructured.Unstructured, s Source) error {
+	unstructured.RemoveNestedField(u.Object, "spec", "source", "git", "tag")
+	return set(u, s, []string{"spec", "source", "git"}, []string{"spec", "source", "git"})
+}
+
+func (gitLayout) Fields(*unstructured.Unstructured) [][]string {
+	return [][]string{{"spec", "source", "git"}}
+}
+
+type gitRefLayout struct{}
+
+func (gitRefLayout) Read(u *unstructured.Unstructured) Source {
+	return Source{
+		URL:     str(u, "spec", "source", "git", "url"),
+		Branch:  str(u, "spec", "source", "git", "ref", "branch"),
+		Tag:     str(u, "spec", "source", "git", "ref", "tag"),
+		Commit:  str(u, "spec", "source", "git", "ref", "commit"),
+		SubPath: str(u, "spec", "source", "subPath"),
+	}
+}
+
+func (gitRefLayout) Write(u *unstructured.Unstructured, s Source) error {
+	unstructured.RemoveNestedField(u.Object, "spec", "source", "git", "ref", "tag")
+	unstructured.RemoveNestedField(u.Object, "spec", "source", "git", "ref", "semver")
+	return set(u, s, []string{"spec", "source", "git"}, []string{"spec", "source", "git", "ref"})
+}
+
+func (gitRefLayout) Fields(*unstructured.Unstructured) [][]string {
+	return [][]string{{"spec", "source", "git"}}
+}
+
+type fluxLayout struct{}
+
+func (fluxLayout) Read(u *unstructured.Unstructured) Source {
+	return Source{
+		URL:    str(u, "spec", "url"),
+		Branch: str(u, "spec", "ref", "branch"),
+		Tag:    str(u, "spec", "ref", "tag"),
+		Commit: str(u, "spec", "ref", "commit"),
+	}
+}
+
+func (fluxLayout) Write(u *unstructured.Unstructured, s Source) error {
+	unstructured.RemoveNestedField(u.Object, "spec", "ref", "tag")
+	unstructured.RemoveNestedField(u.Object, "spec", "ref", "semver")
+	unstructured.RemoveNestedField(u.Object, "spec", "ref", "name")
+	return set(u, s, []string{"spec"}, []string{"spec", "ref"})
+}
+
+func (fluxLayout) Fields(*unstructured.Unstructured) [][]string {
+	return [][]string{{"spec", "url"}, {"spec", "ref"}}
+}
+
+// detectLayout uses the layout of the fields set on each resource, falling back to the git layout.
+type detectLayout struct{}
+
+func (detectLayout) Read(u *unstructured.Unstructured) Source {
+	return detect(u).Read(u)
+}
+
+func (detectLayout) Write(u *unstructured.Unstructured, s Source) error {
+	return detect(u).Write(u, s)
+}
+
+func (detectLayout) Fields(u *unstructured.Unstructured) [][]string {
+	return detect(u).Fields(u)
+}
+
+func detect(u *unstructured.Unstructured) SourceLayout {
+	if _, found, _ := unstructured.NestedMap(u.Object, "spec", "source", "git", "ref"); found {
+		return gitRefLayout{}
+	}
+	if _, found, _ := unstructured.NestedMap(u.Object, "spec", "source", "git"); found {
+		return gitLayout{}
+	}
+	if url := str(u, "spec", "url"); url != "" {
+		return fluxLayout{}
+	}
+	return gitLayout{}
+}
+
+func str(u *unstructured.Unstructured, fields ...string) string {
+	s, _, _ := unstructured.NestedString(u.Object, fields...)
+	return s
+}
+
+// set writes the url to urlFields and the branch and commit to refFields.
+func set(u *unstructured.Unstructured, s Source, urlFields []string, refFields []string) error {
+	if err := unstructured.SetNestedField(u.Object, s.URL, append(urlFields, "url")...); err != nil {
+		return err
+	}
+	if err := unstructured.SetNestedField(u.Object, s.Branch, append(refFields, "branch")...); err != nil {
+		return err
+	}
+	return unstructured.SetNestedField(u.Object, s.Commit, append(refFields, "commit")...)
+}
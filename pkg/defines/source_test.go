@@ -0,0 +1,120 @@
+package defines_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSourceLayout(t *testing.T) {
+	head := defines.Source{URL: "https://github.com/jenkins-x/go-scm", Branch: "feature", Commit: "abc123"}
+
+	tests := []struct {
+		name      string
+		layout    string
+		spec      map[string]interface{}
+		want      defines.Source
+		wantSpec  map[string]interface{}
+		wantError bool
+	}{
+		{
+			name:   "git",
+			layout: defines.SourceLayoutGit,
+			spec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git":     map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "branch": "main"},
+					"subPath": "app",
+				},
+			},
+			want: defines.Source{URL: "https://github.com/jenkins-x/go-scm", Branch: "main", SubPath: "app"},
+			wantSpec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git":     map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "branch": "feature", "commit": "abc123"},
+					"subPath": "app",
+				},
+			},
+		},
+		{
+			name:   "git ref",
+			layout: defines.SourceLayoutGitRef,
+			spec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "ref": map[string]interface{}{"branch": "main"}},
+				},
+			},
+			want: defines.Source{URL: "https://github.com/jenkins-x/go-scm", Branch: "main"},
+			wantSpec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "ref": map[string]interface{}{"branch": "feature", "commit": "abc123"}},
+				},
+			},
+		},
+		{
+			name: "git ref tag is detected and replaced",
+			spec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "ref": map[string]interface{}{"tag": "v1.0.0"}},
+				},
+			},
+			want: defines.Source{URL: "https://github.com/jenkins-x/go-scm", Tag: "v1.0.0"},
+			wantSpec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "ref": map[string]interface{}{"branch": "feature", "commit": "abc123"}},
+				},
+			},
+		},
+		{
+			name: "flux is detected",
+			spec: map[string]interface{}{
+				"url":      "https://github.com/jenkins-x/go-scm",
+				"ref":      map[string]interface{}{"branch": "main"},
+				"interval": "1m",
+			},
+			want: defines.Source{URL: "https://github.com/jenkins-x/go-scm", Branch: "main"},
+			wantSpec: map[string]interface{}{
+				"url":      "https://github.com/jenkins-x/go-scm",
+				"ref":      map[string]interface{}{"branch": "feature", "commit": "abc123"},
+				"interval": "1m",
+			},
+		},
+		{
+			name:   "written when missing",
+			layout: defines.SourceLayoutGitRef,
+			spec:   map[string]interface{}{"params": "a"},
+			want:   defines.Source{},
+			wantSpec: map[string]interface{}{
+				"params": "a",
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "ref": map[string]interface{}{"branch": "feature", "commit": "abc123"}},
+				},
+			},
+		},
+		{
+			name:      "invalid layout",
+			layout:    defines.SourceLayoutGit,
+			spec:      map[string]interface{}{"source": "invalid"},
+			want:      defines.Source{},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": tt.spec}}
+			layout := defines.SourceLayoutFor(tt.layout)
+
+			if got := layout.Read(u); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", got, tt.want)
+			}
+
+			err := layout.Write(u, head)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("Write() error = %v, wantError %v", err, tt.wantError)
+			}
+			if !tt.wantError && !reflect.DeepEqual(u.Object["spec"], tt.wantSpec) {
+				t.Errorf("Write() = %v, want %v", u.Object["spec"], tt.wantSpec)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package defines
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// CopySpec returns a deep copy of the spec of a base resource, to be used as the spec of a pull
+// request resource. Paths are dot separated and relative to the spec, e.g. params or resources.limits.
+// If include is not empty only those paths are copied, any exclude paths are then removed.
+func CopySpec(spec map[string]interface{}, include []string, exclude []string) map[string]interface{} {
+	copied := map[string]interface{}{}
+	if len(include) == 0 {
+		copied = runtime.DeepCopyJSON(spec)
+	} else {
+		for _, path := range include {
+			fields := strings.Split(path, ".")
+			if v, found, _ := unstructured.NestedFieldCopy(spec, fields...); found {
+				_ = unstructured.SetNestedField(copied, v, fields...)
+			}
+		}
+	}
+
+	for _, path := range exclude {
+		unstructured.RemoveNestedField(copied, strings.Split(path, ".")...)
+	}
+	return copied
+}
+
+// neverCopied are the label and annotation keys, or prefixes ending in a slash, that are never copied
+// from a base resource, as they would make the tools that deploy the base resource, or the
+// pr-controller, treat the pull request resource as their own.
+var neverCopied = []string{
+	"kubectl.kubernetes.io/",
+	"kapp.k14s.io/",
+	"argocd.argoproj.io/",
+	"app.kubernetes.io/instance",
+	ManagedByLabel,
+	ManagedBy + "/",
+}
+
+// CopyMetadata returns the labels or annotations of a base resource that should be copied to a pull
+// request resource, those whose keys are allowed. Allowed keys ending in a slash are prefixes, e.g.
+// example.com/ allows example.com/team.
+func CopyMetadata(m map[string]string, allowed []string) map[string]string {
+	copied := make(map[string]string)
+	for k, v := range m {
+		if matchesKey(allowed, k) && !matchesKey(neverCopied, k) {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+func matchesKey(keys []string, k string) bool {
+	for _, key := range keys {
+		if k == key || (strings.HasSuffix(key, "/") && strings.HasPrefix(k, key)) {
+			return true
+		}
+	}
+	return false
+}
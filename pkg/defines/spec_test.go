@@ -0,0 +1,103 @@
+package defines_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+)
+
+func TestCopySpec(t *testing.T) {
+	spec := func() map[string]interface{} {
+		return map[string]interface{}{
+			"source": map[string]interface{}{
+				"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "branch": "main"},
+			},
+			"params": map[string]interface{}{"test": "true"},
+			"resources": map[string]interface{}{
+				"limits":   map[string]interface{}{"cpu": "1"},
+				"requests": map[string]interface{}{"cpu": "100m"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    map[string]interface{}
+	}{
+		{
+			name: "everything",
+			want: spec(),
+		},
+		{
+			name:    "include",
+			include: []string{"params", "resources.limits", "missing"},
+			want: map[string]interface{}{
+				"params":    map[string]interface{}{"test": "true"},
+				"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "1"}},
+			},
+		},
+		{
+			name:    "exclude",
+			exclude: []string{"params", "resources.requests"},
+			want: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "branch": "main"},
+				},
+				"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "1"}},
+			},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"resources"},
+			exclude: []string{"resources.requests"},
+			want: map[string]interface{}{
+				"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "1"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := spec()
+			got := defines.CopySpec(in, tt.include, tt.exclude)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CopySpec() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(in, spec()) {
+				t.Errorf("CopySpec() modified the spec of the base resource: %v", in)
+			}
+		})
+	}
+}
+
+func TestCopyMetadata(t *testing.T) {
+	m := map[string]string{
+		"team":                        "a",
+		"example.com/owner":           "platform",
+		"app.kubernetes.io/name":      "go-scm",
+		"app.kubernetes.io/instance":  "go-scm",
+		"kapp.k14s.io/app":            "1234",
+		"argocd.argoproj.io/instance": "go-scm",
+		defines.ManagedByLabel:        "kapp",
+	}
+
+	tests := []struct {
+		name    string
+		allowed []string
+		want    map[string]string
+	}{
+		{name: "nothing allowed", want: map[string]string{}},
+		{name: "keys", allowed: []string{"team", "example.com/owner"}, want: map[string]string{"team": "a", "example.com/owner": "platform"}},
+		{name: "prefixes", allowed: []string{"app.kubernetes.io/"}, want: map[string]string{"app.kubernetes.io/name": "go-scm"}},
+		{name: "never copied", allowed: []string{"kapp.k14s.io/", "argocd.argoproj.io/instance", defines.ManagedByLabel}, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defines.CopyMetadata(m, tt.allowed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CopyMetadata(%v) = %v, want %v", tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,37 @@
 package defines
 
 import (
+	"fmt"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
-func Workload(chain unstructured.Unstructured) GroupVersionResourceKind {
-	defines, _, err := unstructured.NestedMap(chain.UnstructuredContent(), "spec", "defines")
+// Workload resolves the kind defined by a SupplyChain (spec.defines) to its
+// group, version, resource and kind.
+func Workload(chain unstructured.Unstructured, mapper *Mapper) (GroupVersionResourceKind, error) {
+	group, _, err := unstructured.NestedString(chain.UnstructuredContent(), "spec", "defines", "group")
 	if err != nil {
-		panic(err)
+		return GroupVersionResourceKind{}, err
 	}
-	gvr := GroupVersionResourceKind{
-		Group:    defines["group"].(string),
-		Version:  defines["version"].(string),
-		Resource: strings.ToLower(defines["kind"].(string) + "s"),
-		Kind:     defines["kind"].(string),
+	version, _, err := unstructured.NestedString(chain.UnstructuredContent(), "spec", "defines", "version")
+	if err != nil {
+		return GroupVersionResourceKind{}, err
+	}
+	kind, _, err := unstructured.NestedString(chain.UnstructuredContent(), "spec", "defines", "kind")
+	if err != nil {
+		return GroupVersionResourceKind{}, err
+	}
+	if kind == "" {
+		return GroupVersionResourceKind{}, fmt.Errorf("supply chain %s does not define a kind", chain.GetName())
 	}
-	return gvr
+
+	return mapper.ResourceFor(schema.GroupVersionKind{
+		Group:   group,
+		Version: version,
+		Kind:    kind,
+	})
 }
 
 type GroupVersionResourceKind struct {
@@ -28,6 +41,15 @@ type GroupVersionResourceKind struct {
 	Kind     string
 }
 
+// IsPullRequest returns true if this is the pull request type for another kind, e.g. *PullRequest or *PR.
+func (g *GroupVersionResourceKind) IsPullRequest() bool {
+	if g.Kind != "" {
+		kind := strings.ToLower(g.Kind)
+		return strings.HasSuffix(kind, "pr") || strings.HasSuffix(kind, "pullrequest")
+	}
+	return strings.HasSuffix(g.Resource, "prs") || strings.HasSuffix(g.Resource, "pullrequests")
+}
+
 func (g *GroupVersionResourceKind) ToGroupVersionResource() schema.GroupVersionResource {
 	return schema.GroupVersionResource{
 		Group:    g.Group,
@@ -0,0 +1,74 @@
+package defines_test
+
+import (
+	"testing"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/internal/fixtures"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWorkload(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "policies", SingularName: "policy", Namespaced: true, Kind: "Policy"},
+				{Name: "policyprs", SingularName: "policypr", Namespaced: true, Kind: "PolicyPR"},
+			},
+		},
+	}
+
+	mapper := defines.NewMapper(fakeDiscovery)
+
+	tests := []struct {
+		kind string
+		want defines.GroupVersionResourceKind
+	}{
+		{
+			kind: "Policy",
+			want: defines.GroupVersionResourceKind{Group: "example.com", Version: "v1alpha1", Resource: "policies", Kind: "Policy"},
+		},
+		{
+			kind: "PolicyPR",
+			want: defines.GroupVersionResourceKind{Group: "example.com", Version: "v1alpha1", Resource: "policyprs", Kind: "PolicyPR"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			got, err := defines.Workload(*fixtures.SupplyChain(tt.kind, tt.kind), mapper)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Workload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unknown kind", func(t *testing.T) {
+		if _, err := defines.Workload(*fixtures.SupplyChain("Proxy", "Proxy"), mapper); err == nil {
+			t.Errorf("expected an error for an unknown kind")
+		}
+	})
+
+	t.Run("refreshes on miss", func(t *testing.T) {
+		fakeDiscovery.Resources[0].APIResources = append(fakeDiscovery.Resources[0].APIResources,
+			v1.APIResource{Name: "proxies", SingularName: "proxy", Namespaced: true, Kind: "Proxy"})
+
+		got, err := defines.Workload(*fixtures.SupplyChain("Proxy", "Proxy"), mapper)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Resource != "proxies" {
+			t.Errorf("Workload() resource = %s, want proxies", got.Resource)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+// Package applytest emulates server-side apply on the fake dynamic client for the tests of the
+// packages that apply pull request resources.
+package applytest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// appliedFields are the maps whose entries are owned by the field manager that applied them.
+var appliedFields = [][]string{
+	{"metadata", "labels"},
+	{"metadata", "annotations"},
+	{"spec"},
+}
+
+// AddReactor emulates server-side apply on the fake dynamic client, which only supports create,
+// update and merge patches. Applies create the object if it doesn't exist, or update it
+// otherwise. As with a real apply, the entries of the labels, annotations, spec and owner
+// references that were applied previously but are no longer applied are removed, entries set by
+// other writers are kept, and the apply fails if the API version of the applied object doesn't match
+// the resource or conflicts if the applied resource version is out of date.
+func AddReactor(d *dynamicfake.FakeDynamicClient) {
+	var lock sync.Mutex
+	managed := make(map[string]map[string][]string)
+
+	d.PrependReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch, ok := action.(clienttesting.PatchAction)
+		if !ok || patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+
+		applied := &unstructured.Unstructured{}
+		if err := applied.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+
+		gvr, namespace, name := patch.GetResource(), patch.GetNamespace(), patch.GetName()
+		key := fmt.Sprintf("%s/%s/%s", gvr, namespace, name)
+		if gv := applied.GroupVersionKind().GroupVersion(); gv != gvr.GroupVersion() {
+			return true, nil, apierrors.NewBadRequest(fmt.Sprintf("the API version in the data (%s) does not match the expected API version (%s)", gv, gvr.GroupVersion()))
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		obj, err := d.Tracker().Get(gvr, namespace, name)
+		if apierrors.IsNotFound(err) {
+			applied.SetResourceVersion("")
+			if err := d.Tracker().Create(gvr, applied.DeepCopy(), namespace); err != nil {
+				return true, nil, err
+			}
+			managed[key] = ownedFields(applied)
+			return true, applied, nil
+		} else if err != nil {
+			return true, nil, err
+		}
+
+		existing, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return true, nil, fmt.Errorf("unexpected %T for %s", obj, key)
+		}
+		existing = existing.DeepCopy()
+
+		if rv := applied.GetResourceVersion(); rv != "" && rv != existing.GetResourceVersion() {
+			return true, nil, apierrors.NewConflict(gvr.GroupResource(), name, errors.New("the object has been modified"))
+		}
+
+		previous := managed[key]
+		for _, path := range appliedFields {
+			m, _, _ := unstructured.NestedMap(existing.Object, path...)
+			if m == nil {
+				m = make(map[string]interface{})
+			}
+			for _, k := range previous[strings.Join(path, ".")] {
+				delete(m, k)
+			}
+			values, _, _ := unstructured.NestedMap(applied.Object, path...)
+			for k, v := range values {
+				m[k] = v
+			}
+			if err := unstructured.SetNestedMap(existing.Object, m, path...); err != nil {
+				return true, nil, err
+			}
+		}
+
+		refs := applied.GetOwnerReferences()
+		for _, ref := range existing.GetOwnerReferences() {
+			if !containsUID(previous["ownerReferences"], string(ref.UID)) && !containsUID(ownerUIDs(applied), string(ref.UID)) {
+				refs = append(refs, ref)
+			}
+		}
+		existing.SetOwnerReferences(refs)
+
+		if err := d.Tracker().Update(gvr, existing.DeepCopy(), namespace); err != nil {
+			return true, nil, err
+		}
+		managed[key] = ownedFields(applied)
+		return true, existing, nil
+	})
+}
+
+// ownedFields returns the keys of the entries set by the applied object.
+func ownedFields(applied *unstructured.Unstructured) map[string][]string {
+	m := map[string][]string{"ownerReferences": ownerUIDs(applied)}
+	for _, path := range appliedFields {
+		values, _, _ := unstructured.NestedMap(applied.Object, path...)
+		for k := range values {
+			m[strings.Join(path, ".")] = append(m[strings.Join(path, ".")], k)
+		}
+	}
+	return m
+}
+
+func ownerUIDs(u *unstructured.Unstructured) []string {
+	var uids []string
+	for _, ref := range u.GetOwnerReferences() {
+		uids = append(uids, string(ref.UID))
+	}
+	return uids
+}
+
+func containsUID(values []string, v string) bool {
+	for _, i := range values {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+// Package fixtures builds the SupplyChains and resources shared by the tests, which define and use
+// kinds in the example.com/v1alpha1 group.
+package fixtures
+
+import "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+// SupplyChain returns a SupplyChain defining the kind in the example.com/v1alpha1 group.
+func SupplyChain(name string, kind string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "supply-chain.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "SupplyChain",
+		"metadata": map[string]interface{}{
+			"name": name,
+		},
+		"spec": map[string]interface{}{
+			"defines": map[string]interface{}{
+				"group":   "example.com",
+				"version": "v1alpha1",
+				"kind":    kind,
+			},
+		},
+	}}
+}
+
+// Example returns an Example built from the branch of the git url.
+func Example(name string, namespace string, gitURL string, branch string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1alpha1",
+		"kind":       "Example",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{
+				"git": map[string]interface{}{
+					"url":    gitURL,
+					"branch": branch,
+				},
+			},
+		},
+	}}
+}
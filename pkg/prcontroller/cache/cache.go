@@ -0,0 +1,482 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// GitIndex is the name of the index of workload resources by git url and branch.
+const GitIndex = "git"
+
+// SyncTimeout is how long to wait for the informer of a kind to sync, which never happens if the
+// controller is not allowed to list the kind.
+var SyncTimeout = 30 * time.Second
+
+// SupplyChainGVR is the resource for supply chains.
+var SupplyChainGVR = schema.GroupVersionResource{
+	Group:    "supply-chain.apps.tanzu.vmware.com",
+	Version:  "v1alpha1",
+	Resource: "supplychains",
+}
+
+// Cache is an informer backed cache of SupplyChains and the kinds they define. Resources of each kind
+// are indexed by git url and branch, so matching a webhook to its workloads does not need to list
+// every resource in the cluster.
+type Cache struct {
+	factory dynamicinformer.DynamicSharedInformerFactory
+	mapper  *defines.Mapper
+	stop    <-chan struct{}
+
+	lock sync.RWMutex
+	// kinds are the kinds defined by each supply chain, keyed by supply chain name.
+	kinds map[string]defines.GroupVersionResourceKind
+	// options are the options configured on each supply chain, keyed by supply chain name.
+	options map[string]defines.Options
+	// indexed are the resources that have had the git index added to their informer.
+	indexed map[schema.GroupVersionResource]bool
+	// mappings are the PullRequestMappings and ClusterPullRequestMappings, keyed by namespace and name.
+	mappings map[string]defines.Mapping
+
+	handlersLock   sync.RWMutex
+	handlers       []ChangeFunc
+	deleteHandlers []ChangeFunc
+}
+
+// ChangeFunc is called when a resource of a kind defined by a supply chain is added, updated or deleted.
+type ChangeFunc func(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured)
+
+// New creates a new Cache.
+func New(d dynamic.Interface, mapper *defines.Mapper, resync time.Duration) *Cache {
+	return &Cache{
+		factory:  dynamicinformer.NewDynamicSharedInformerFactory(d, resync),
+		mapper:   mapper,
+		kinds:    make(map[string]defines.GroupVersionResourceKind),
+		options:  make(map[string]defines.Options),
+		indexed:  make(map[schema.GroupVersionResource]bool),
+		mappings: make(map[string]defines.Mapping),
+	}
+}
+
+// Start starts watching SupplyChains and waits for at most the SyncTimeout for the initial list of
+// them to be loaded. Informers for each defined kind are started as SupplyChains are discovered, and
+// all informers stop when the context is done, or if the SupplyChains cannot be loaded so that
+// retrying with a new Cache does not leak them.
+func (c *Cache) Start(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+	c.stop = ctx.Done()
+
+	informer := c.factory.ForResource(SupplyChainGVR).Informer()
+	_, err = informer.AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.addSupplyChain(obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			c.addSupplyChain(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.deleteSupplyChain(obj)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	synced := []k8scache.InformerSynced{informer.HasSynced}
+	for _, gvk := range []schema.GroupVersionKind{defines.PullRequestMappingGVK, defines.ClusterPullRequestMappingGVK} {
+		gvrk, err := c.mapper.ResourceFor(gvk)
+		if err != nil {
+			logrus.Infof("not watching %s, it is not installed: %v", gvk.Kind, err)
+			continue
+		}
+
+		informer := c.factory.ForResource(gvrk.ToGroupVersionResource()).Informer()
+		_, err = informer.AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.addMapping(obj)
+			},
+			UpdateFunc: func(_, obj interface{}) {
+				c.addMapping(obj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				c.deleteMapping(obj)
+			},
+		})
+		if err != nil {
+			return err
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+
+	c.factory.Start(c.stop)
+
+	syncCtx, cancel := context.WithTimeout(ctx, SyncTimeout)
+	defer cancel()
+
+	if !k8scache.WaitForCacheSync(syncCtx.Done(), synced...) {
+		return fmt.Errorf("unable to sync supply chains, check they are installed and the controller is allowed to list them")
+	}
+
+	return nil
+}
+
+// Kinds returns the kinds defined by all known SupplyChains.
+func (c *Cache) Kinds() []defines.GroupVersionResourceKind {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	seen := make(map[defines.GroupVersionResourceKind]bool)
+	kinds := make([]defines.GroupVersionResourceKind, 0, len(c.kinds))
+	for _, k := range c.kinds {
+		if !seen[k] {
+			seen[k] = true
+			kinds = append(kinds, k)
+		}
+	}
+	return kinds
+}
+
+// Options returns the options configured on the supply chain that defines the kind. If several supply
+// chains define the kind, the options of the first by name are used.
+func (c *Cache) Options(gvrk defines.GroupVersionResourceKind) defines.Options {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var names []string
+	for name, k := range c.kinds {
+		if k == gvrk {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return defines.Options{}
+	}
+	sort.Strings(names)
+	return c.options[names[0]]
+}
+
+// Mappings returns all known PullRequestMappings and ClusterPullRequestMappings.
+func (c *Cache) Mappings() []defines.Mapping {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	mappings := make([]defines.Mapping, 0, len(c.mappings))
+	for _, m := range c.mappings {
+		// namespaced mappings can only create kinds defined by a supply chain, so that they cannot use the
+		// controller's permissions to create any other kind of resource
+		if m.Namespace != "" && !c.defined(m.PullRequest) {
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Namespace+"/"+mappings[i].Name < mappings[j].Namespace+"/"+mappings[j].Name
+	})
+	return mappings
+}
+
+// OnChange registers a function that is called whenever a resource of a kind defined by a supply
+// chain is added or updated.
+func (c *Cache) OnChange(f ChangeFunc) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	c.handlers = append(c.handlers, f)
+}
+
+// OnDelete registers a function that is called whenever a resource of a kind defined by a supply
+// chain is deleted.
+func (c *Cache) OnDelete(f ChangeFunc) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	c.deleteHandlers = append(c.deleteHandlers, f)
+}
+
+// Lookup returns all resources of the given kind that are built from the git url and branch.
+func (c *Cache) Lookup(ctx context.Context, gvrk defines.GroupVersionResourceKind, gitURL string, branch string) ([]*unstructured.Unstructured, error) {
+	informer, err := c.synced(ctx, gvrk)
+	if err != nil {
+		return nil, err
+	}
+
+	objs, err := informer.GetIndexer().ByIndex(GitIndex, layoutKey(c.Options(gvrk).SourceLayout, IndexKey(gitURL, branch)))
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			resources = append(resources, u)
+		}
+	}
+	return resources, nil
+}
+
+// List returns all resources of the given kind.
+func (c *Cache) List(ctx context.Context, gvrk defines.GroupVersionResourceKind) ([]*unstructured.Unstructured, error) {
+	informer, err := c.synced(ctx, gvrk)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := informer.GetIndexer().List()
+	resources := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			resources = append(resources, u)
+		}
+	}
+	return resources, nil
+}
+
+// Get returns the resource of the given kind with the namespace and name, if it exists.
+func (c *Cache) Get(ctx context.Context, gvrk defines.GroupVersionResourceKind, namespace string, name string) (*unstructured.Unstructured, bool, error) {
+	informer, err := c.synced(ctx, gvrk)
+	if err != nil {
+		return nil, false, err
+	}
+
+	obj, exists, err := informer.GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	return u, ok, nil
+}
+
+// synced returns the informer of the kind once it has synced, waiting until the context is done or
+// for at most the SyncTimeout.
+func (c *Cache) synced(ctx context.Context, gvrk defines.GroupVersionResourceKind) (k8scache.SharedIndexInformer, error) {
+	informer := c.factory.ForResource(gvrk.ToGroupVersionResource()).Informer()
+	if informer.HasSynced() {
+		return informer, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, SyncTimeout)
+	defer cancel()
+
+	if !k8scache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("unable to sync %s, check the controller is allowed to list them", gvrk.Resource)
+	}
+	return informer, nil
+}
+
+// IndexKey builds the key for the git index from the canonical form of a git url and a branch.
+func IndexKey(gitURL string, branch string) string {
+	return fmt.Sprintf("%s#%s", scmclient.Canonical(gitURL), branch)
+}
+
+// layouts are the source layouts resources are indexed with, the empty layout detects the layout of
+// each resource.
+var layouts = []string{"", defines.SourceLayoutGit, defines.SourceLayoutGitRef, defines.SourceLayoutFlux}
+
+// layoutKey qualifies a key of the git index with the source layout it was read with, unknown
+// layouts detect the layout of each resource.
+func layoutKey(layout string, key string) string {
+	for _, l := range layouts {
+		if l == layout {
+			return layout + "|" + key
+		}
+	}
+	return "|" + key
+}
+
+// gitIndex indexes resources by the url and branch of their source read with every source layout, so
+// that resources are found with the layout currently configured on the supply chain that defines the
+// kind without reindexing them when it changes, or reading the options from the index.
+func gitIndex(obj interface{}) ([]string, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, layout := range layouts {
+		source := defines.SourceLayoutFor(layout).Read(u)
+		if source.URL != "" {
+			keys = append(keys, layoutKey(layout, IndexKey(source.URL, source.Branch)))
+		}
+	}
+	return keys, nil
+}
+
+func (c *Cache) addSupplyChain(obj interface{}) {
+	chain, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	gvrk, err := defines.Workload(*chain, c.mapper)
+	if err != nil {
+		logrus.Warnf("unable to resolve the kind defined by supply chain %s: %v", chain.GetName(), err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for name, k := range c.kinds {
+		if k == gvrk && name != chain.GetName() {
+			logrus.Warnf("supply chains %s and %s both define %s, the options of the first by name are used", name, chain.GetName(), gvrk.Kind)
+		}
+	}
+	c.kinds[chain.GetName()] = gvrk
+	c.options[chain.GetName()] = defines.OptionsFor(*chain)
+
+	c.watch(gvrk, "supply chain "+chain.GetName())
+}
+
+// watch starts an informer for the kind, indexed by git url and branch, if it is not already running.
+// It must be called with the lock held.
+func (c *Cache) watch(gvrk defines.GroupVersionResourceKind, source string) {
+	gvr := gvrk.ToGroupVersionResource()
+	if c.indexed[gvr] {
+		return
+	}
+
+	informer := c.factory.ForResource(gvr).Informer()
+	if err := informer.AddIndexers(k8scache.Indexers{GitIndex: gitIndex}); err != nil {
+		logrus.Errorf("unable to index %s: %v", gvr.Resource, err)
+		return
+	}
+	_, err := informer.AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.changed(gvrk, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			c.changed(gvrk, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.deleted(gvrk, obj)
+		},
+	})
+	if err != nil {
+		logrus.Errorf("unable to watch %s: %v", gvr.Resource, err)
+		return
+	}
+	c.indexed[gvr] = true
+
+	logrus.Infof("watching %s defined by %s", gvr.Resource, source)
+	c.factory.Start(c.stop)
+}
+
+func (c *Cache) deleteSupplyChain(obj interface{}) {
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	chain, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// the informer keeps running, so resources are still available if the supply chain is recreated.
+	delete(c.kinds, chain.GetName())
+	delete(c.options, chain.GetName())
+}
+
+func (c *Cache) addMapping(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	key := u.GetNamespace() + "/" + u.GetName()
+	m, err := defines.MappingFor(*u, c.mapper)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		logrus.Warnf("unable to load %s %s: %v", u.GetKind(), key, err)
+		delete(c.mappings, key)
+		return
+	}
+
+	logrus.Infof("mapping %s to %s with %s %s", m.Base.Kind, m.PullRequest.Kind, u.GetKind(), key)
+	c.mappings[key] = m
+	if m.Namespace != "" {
+		// the kind is watched once a supply chain defines it
+		if !c.defined(m.PullRequest) {
+			logrus.Warnf("ignoring %s %s until a supply chain defines %s", u.GetKind(), key, m.PullRequest.Kind)
+		}
+		return
+	}
+	c.watch(m.PullRequest, u.GetKind()+" "+key)
+}
+
+// defined returns true if a supply chain defines the kind, the lock must be held.
+func (c *Cache) defined(gvrk defines.GroupVersionResourceKind) bool {
+	for _, k := range c.kinds {
+		if k == gvrk {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) deleteMapping(obj interface{}) {
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.mappings, u.GetNamespace()+"/"+u.GetName())
+}
+
+func (c *Cache) changed(gvrk defines.GroupVersionResourceKind, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	c.handlersLock.RLock()
+	defer c.handlersLock.RUnlock()
+
+	for _, f := range c.handlers {
+		f(gvrk, u)
+	}
+}
+
+func (c *Cache) deleted(gvrk defines.GroupVersionResourceKind, obj interface{}) {
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	c.handlersLock.RLock()
+	defer c.handlersLock.RUnlock()
+
+	for _, f := range c.deleteHandlers {
+		f(gvrk, u)
+	}
+}
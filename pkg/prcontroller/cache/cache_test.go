@@ -0,0 +1,439 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/internal/fixtures"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	exampleGVR = schema.GroupVersionResource{
+		Group:    "example.com",
+		Version:  "v1alpha1",
+		Resource: "examples",
+	}
+
+	exampleGVRK = defines.GroupVersionResourceKind{
+		Group:    "example.com",
+		Version:  "v1alpha1",
+		Resource: "examples",
+		Kind:     "Example",
+	}
+)
+
+func TestCache(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+				{Name: "examplepullrequests", SingularName: "examplepullrequest", Namespaced: true, Kind: "ExamplePullRequest"},
+			},
+		},
+	}
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+			exampleGVR:           "ExampleList",
+			{Group: "example.com", Version: "v1alpha1", Resource: "examplepullrequests"}: "ExamplePullRequestList",
+		},
+		fixtures.SupplyChain("example", "Example"),
+		fixtures.Example("go-scm", "ns-1", "https://github.com/jenkins-x/go-scm.git", "main"),
+		fixtures.Example("go-scm", "ns-2", "https://github.com/jenkins-x/go-scm", "main"),
+		fixtures.Example("go-scm", "ns-3", "git@GitHub.com:jenkins-x/go-scm.git", "main"),
+		fixtures.Example("go-scm-release", "ns-1", "https://github.com/jenkins-x/go-scm", "release"),
+		fixtures.Example("other", "ns-1", "https://github.com/jenkins-x/other", "main"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := c.Kinds()
+	if len(kinds) != 1 || kinds[0] != exampleGVRK {
+		t.Fatalf("Kinds() = %v, want [%v]", kinds, exampleGVRK)
+	}
+
+	got, err := c.Lookup(ctx, exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("Lookup() returned %d resources, want 3", len(got))
+	}
+
+	// new supply chains are picked up dynamically
+	_, err = d.Resource(cache.SupplyChainGVR).Create(ctx, fixtures.SupplyChain("example-pr", "ExamplePullRequest"), v1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.Kinds()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the new supply chain, got %v", c.Kinds())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheOnDelete(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+			},
+		},
+	}
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+			exampleGVR:           "ExampleList",
+		},
+		fixtures.SupplyChain("example", "Example"),
+		fixtures.Example("go-scm", "ns-1", "https://github.com/jenkins-x/go-scm.git", "main"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	deleted := make(chan string, 1)
+	c.OnDelete(func(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) {
+		deleted <- gvrk.Kind + " " + obj.GetNamespace() + "/" + obj.GetName()
+	})
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lookup(ctx, exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Resource(exampleGVR).Namespace("ns-1").Delete(ctx, "go-scm", v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-deleted:
+		if got != "Example ns-1/go-scm" {
+			t.Errorf("deleted %s, want Example ns-1/go-scm", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the delete")
+	}
+}
+
+func TestCacheUnlistableKind(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+			},
+		},
+	}
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+			exampleGVR:           "ExampleList",
+		},
+		fixtures.SupplyChain("example", "Example"),
+	)
+	// the controller is not allowed to list the kind, so its informer never syncs
+	d.PrependReactor("list", "examples", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(exampleGVR.GroupResource(), "", errors.New("not allowed"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := cache.SyncTimeout
+	cache.SyncTimeout = 200 * time.Millisecond
+	defer func() { cache.SyncTimeout = timeout }()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Lookup(context.Background(), exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Lookup() to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lookup() did not return after the sync timeout")
+	}
+}
+
+func TestCacheUnlistableSupplyChains(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+			},
+		},
+	}
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+		},
+	)
+	// supply chains are not installed, so their informer never syncs
+	d.PrependReactor("list", "supplychains", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(cache.SupplyChainGVR.GroupResource(), "")
+	})
+
+	timeout := cache.SyncTimeout
+	cache.SyncTimeout = 200 * time.Millisecond
+	defer func() { cache.SyncTimeout = timeout }()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute).Start(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Start() to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() did not return after the sync timeout")
+	}
+}
+
+func TestCacheOptionsDefinedTwice(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+			},
+		},
+	}
+
+	first := fixtures.SupplyChain("a-example", "Example")
+	first.SetAnnotations(map[string]string{defines.StatusContextAnnotation: "first"})
+	second := fixtures.SupplyChain("b-example", "Example")
+	second.SetAnnotations(map[string]string{defines.StatusContextAnnotation: "second"})
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+			exampleGVR:           "ExampleList",
+		},
+		second,
+		first,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// map iteration is random, so check the same supply chain is picked every time
+	for i := 0; i < 20; i++ {
+		if got := c.Options(exampleGVRK).StatusContext; got != "first" {
+			t.Fatalf("Options().StatusContext = %q, want first", got)
+		}
+	}
+}
+
+func TestCacheSourceLayoutChanged(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+			},
+		},
+	}
+
+	chain := fixtures.SupplyChain("example", "Example")
+	chain.SetAnnotations(map[string]string{defines.SourceLayoutAnnotation: defines.SourceLayoutFlux})
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+			exampleGVR:           "ExampleList",
+		},
+		chain,
+		fixtures.Example("go-scm", "ns-1", "https://github.com/jenkins-x/go-scm.git", "main"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.Lookup(ctx, exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Lookup() returned %d resources with the flux layout, want 0", len(got))
+	}
+
+	// the resources are found with the new layout without being reindexed
+	chain.SetAnnotations(map[string]string{defines.SourceLayoutAnnotation: defines.SourceLayoutGit})
+	if _, err := d.Resource(cache.SupplyChainGVR).Update(ctx, chain, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := c.Lookup(ctx, exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the git layout, Lookup() returned %d resources", len(got))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheIndexesStartedInformer(t *testing.T) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+				{Name: "others", SingularName: "other", Namespaced: true, Kind: "Other"},
+			},
+		},
+	}
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR: "SupplyChainList",
+			exampleGVR:           "ExampleList",
+			{Group: "example.com", Version: "v1alpha1", Resource: "others"}: "OtherList",
+		},
+		fixtures.Example("go-scm", "ns-1", "https://github.com/jenkins-x/go-scm.git", "main"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// looking up a kind no supply chain defines creates its informer, which is started and loads the
+	// resources when another kind is watched
+	timeout := cache.SyncTimeout
+	cache.SyncTimeout = 100 * time.Millisecond
+	_, _ = c.Lookup(ctx, exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main")
+	cache.SyncTimeout = timeout
+
+	if _, err := d.Resource(cache.SupplyChainGVR).Create(ctx, fixtures.SupplyChain("other", "Other"), v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForKinds(t, c, 1)
+	if _, err := c.List(ctx, exampleGVRK); err != nil {
+		t.Fatal(err)
+	}
+
+	// indexing the loaded resources must not wait for the lock held while the kind is watched
+	if _, err := d.Resource(cache.SupplyChainGVR).Create(ctx, fixtures.SupplyChain("example", "Example"), v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForKinds(t, c, 2)
+
+	got, err := c.Lookup(ctx, exampleGVRK, "https://github.com/jenkins-x/go-scm.git", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("Lookup() returned %d resources, want 1", len(got))
+	}
+}
+
+func waitForKinds(t *testing.T, c *cache.Cache, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.Kinds()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d kinds, got %v", n, c.Kinds())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,185 @@
+package configmap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+// DefaultMaxEntries is the default number of entries kept in a ConfigMap, which keeps it well under
+// the 1MiB limit as the whole ConfigMap is read and written for every update.
+const DefaultMaxEntries = 1000
+
+// maxKeyLength is the longest key a ConfigMap accepts.
+const maxKeyLength = 253
+
+// GVR is the resource for ConfigMaps.
+var GVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+var invalidKey = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+
+// Entry is a value in a Store with the time it was added.
+type Entry struct {
+	Value string
+	Added time.Time
+}
+
+// Store is a set of entries in a ConfigMap, so that they survive restarts and are shared by every
+// replica. Entries are forgotten after the ttl, and the oldest entries are forgotten when there are
+// more than maxEntries.
+type Store struct {
+	client     dynamic.ResourceInterface
+	namespace  string
+	name       string
+	ttl        time.Duration
+	maxEntries int
+}
+
+// New creates a Store of up to maxEntries entries for the ttl in the ConfigMap, which is created if it
+// doesn't exist.
+func New(d dynamic.Interface, namespace string, name string, ttl time.Duration, maxEntries int) *Store {
+	return &Store{
+		client:     d.Resource(GVR).Namespace(namespace),
+		namespace:  namespace,
+		name:       name,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+	}
+}
+
+// Key returns a valid ConfigMap key for s, replacing the characters a key cannot contain and hashing
+// the end of keys that are too long.
+func Key(s string) string {
+	k := invalidKey.ReplaceAllString(s, "_")
+	if len(k) <= maxKeyLength {
+		return k
+	}
+	sum := sha256.Sum256([]byte(s))
+	suffix := hex.EncodeToString(sum[:8])
+	return k[:maxKeyLength-len(suffix)-1] + "_" + suffix
+}
+
+// Get returns the unexpired entry for the key.
+func (s *Store) Get(ctx context.Context, key string) (Entry, bool, error) {
+	cm, err := s.client.Get(ctx, s.name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return Entry{}, false, nil
+	} else if err != nil {
+		return Entry{}, false, err
+	}
+
+	e, ok := s.entries(cm, time.Now())[key]
+	return e, ok, nil
+}
+
+// Update applies fn to the unexpired entries, saving them if fn returns true. Updates that conflict
+// with another replica are retried.
+func (s *Store) Update(ctx context.Context, fn func(entries map[string]Entry, now time.Time) bool) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		cm, err := s.client.Get(ctx, s.name, v1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			cm = &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name":      s.name,
+					"namespace": s.namespace,
+				},
+			}}
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		entries := s.entries(cm, now)
+		if !fn(entries, now) {
+			return nil
+		}
+
+		added := make(map[string]time.Time, len(entries))
+		for k, e := range entries {
+			added[k] = e.Added
+		}
+		Prune(added, now, s.ttl, s.maxEntries)
+
+		data := make(map[string]string, len(added))
+		for k := range added {
+			data[k] = format(entries[k])
+		}
+		if err := unstructured.SetNestedStringMap(cm.Object, data, "data"); err != nil {
+			return err
+		}
+
+		if exists {
+			_, err = s.client.Update(ctx, cm, v1.UpdateOptions{})
+		} else {
+			_, err = s.client.Create(ctx, cm, v1.CreateOptions{})
+		}
+		return err
+	})
+}
+
+// entries returns the unexpired entries in the ConfigMap, each stored as the time it was added
+// optionally followed by a space and its value.
+func (s *Store) entries(cm *unstructured.Unstructured, now time.Time) map[string]Entry {
+	data, _, _ := unstructured.NestedStringMap(cm.Object, "data")
+	entries := make(map[string]Entry, len(data))
+	for k, v := range data {
+		added, value, _ := strings.Cut(v, " ")
+		t, err := time.Parse(time.RFC3339Nano, added)
+		if err != nil || now.Sub(t) >= s.ttl {
+			continue
+		}
+		entries[k] = Entry{Value: value, Added: t}
+	}
+	return entries
+}
+
+func format(e Entry) string {
+	added := e.Added.UTC().Format(time.RFC3339Nano)
+	if e.Value == "" {
+		return added
+	}
+	return added + " " + e.Value
+}
+
+// Prune removes the expired entries, then the oldest entries until there are at most maxEntries. Entries
+// added at the same time are removed in order of their key.
+func Prune(entries map[string]time.Time, now time.Time, ttl time.Duration, maxEntries int) {
+	for k, added := range entries {
+		if now.Sub(added) >= ttl {
+			delete(entries, k)
+		}
+	}
+	if maxEntries <= 0 || len(entries) <= maxEntries {
+		return
+	}
+
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := entries[keys[i]], entries[keys[j]]; !a.Equal(b) {
+			return a.Before(b)
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys[:len(keys)-maxEntries] {
+		delete(entries, k)
+	}
+}
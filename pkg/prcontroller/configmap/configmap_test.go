@@ -0,0 +1,101 @@
+package configmap_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newClient() dynamic.Interface {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{configmap.GVR: "ConfigMapList"})
+}
+
+func add(t *testing.T, s *configmap.Store, key string, value string) {
+	t.Helper()
+
+	err := s.Update(context.Background(), func(entries map[string]configmap.Entry, now time.Time) bool {
+		entries[key] = configmap.Entry{Value: value, Added: now}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	d := newClient()
+	s := configmap.New(d, "pr-controller", "entries", time.Hour, 2)
+
+	add(t, s, "first", "1")
+	time.Sleep(10 * time.Millisecond)
+	add(t, s, "second", "")
+	add(t, s, "third", "3 with spaces")
+
+	if _, ok, err := s.Get(context.Background(), "first"); err != nil || ok {
+		t.Errorf("Get(first) = %v, %v, want the oldest entry to be pruned", ok, err)
+	}
+	for key, want := range map[string]string{"second": "", "third": "3 with spaces"} {
+		got, ok, err := s.Get(context.Background(), key)
+		if err != nil || !ok || got.Value != want {
+			t.Errorf("Get(%s) = %+v, %v, %v, want %q", key, got, ok, err, want)
+		}
+	}
+
+	cm, err := d.Resource(configmap.GVR).Namespace("pr-controller").Get(context.Background(), "entries", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := unstructured.NestedStringMap(cm.Object, "data"); len(data) != 2 {
+		t.Errorf("data = %v, want 2 entries", data)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s := configmap.New(newClient(), "pr-controller", "entries", time.Second, 10)
+
+	add(t, s, "first", "1")
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, ok, err := s.Get(context.Background(), "first"); err != nil || ok {
+		t.Errorf("Get(first) = %v, %v, want the entry to have expired", ok, err)
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "valid", in: "github-1234.abc_def", want: "github-1234.abc_def"},
+		{name: "slashes", in: "ExamplePullRequest/my-namespace/go-scm-pr-1", want: "ExamplePullRequest_my-namespace_go-scm-pr-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := configmap.Key(tt.in); got != tt.want {
+				t.Errorf("Key(%s) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("too long", func(t *testing.T) {
+		a := configmap.Key(strings.Repeat("a", 300) + "1")
+		b := configmap.Key(strings.Repeat("a", 300) + "2")
+		if len(a) > 253 || len(b) > 253 {
+			t.Errorf("Key() = %d and %d characters, want at most 253", len(a), len(b))
+		}
+		if a == b {
+			t.Errorf("Key() = %s for different long keys", a)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"github.com/jenkins-x/go-scm/scm"
+)
+
+// operation is what is done to the pull request resources for an event.
+type operation int
+
+const (
+	// operationIgnore leaves the pull request resources unchanged.
+	operationIgnore operation = iota
+	// operationApply creates or updates the pull request resources, unless the pull request is a draft
+	// or doesn't change the paths a base resource is built from, in which case they are deleted.
+	operationApply
+	// operationDelete deletes the pull request resources.
+	operationDelete
+)
+
+// operations is the operation for every go-scm action. The drivers map their own events onto these
+// actions, e.g. new commits are a GitHub synchronize, Gitea and Gogs synchronized, Bitbucket
+// pullrequest:updated and Bitbucket Server pr:from_ref_updated, which are all ActionSync, while
+// GitLab only sends update. Actions that change the title or labels are applied as they can change the
+// rendered mappings, converting to a draft deletes the resources as not every driver reports the draft
+// state, and actions that only change reviewers or assignees are ignored, as are unknown actions.
+var operations = map[scm.Action]operation{
+	scm.ActionCreate:               operationApply,
+	scm.ActionUpdate:               operationApply,
+	scm.ActionDelete:               operationDelete,
+	scm.ActionOpen:                 operationApply,
+	scm.ActionReopen:               operationApply,
+	scm.ActionClose:                operationDelete,
+	scm.ActionLabel:                operationApply,
+	scm.ActionUnlabel:              operationApply,
+	scm.ActionSync:                 operationApply,
+	scm.ActionMerge:                operationDelete,
+	scm.ActionAssigned:             operationIgnore,
+	scm.ActionUnassigned:           operationIgnore,
+	scm.ActionReviewRequested:      operationIgnore,
+	scm.ActionReviewRequestRemoved: operationIgnore,
+	scm.ActionReadyForReview:       operationApply,
+	scm.ActionConvertedToDraft:     operationDelete,
+	scm.ActionEdited:               operationApply,
+	scm.ActionSubmitted:            operationIgnore,
+	scm.ActionDismissed:            operationIgnore,
+	scm.ActionCompleted:            operationIgnore,
+}
+
+// operationFor returns the operation for the event. Events for a closed or merged pull request always
+// delete its resources, as Azure DevOps reports an abandoned pull request as an update.
+func operationFor(pr *scm.PullRequestHook) operation {
+	op := operations[pr.Action]
+	if op == operationApply && (pr.PullRequest.Closed || pr.PullRequest.Merged) {
+		return operationDelete
+	}
+	return op
+}
+
+// closedOrMerged returns true if the event closes, merges or deletes the pull request, rather than
+// only converting it to a draft.
+func closedOrMerged(pr *scm.PullRequestHook) bool {
+	switch pr.Action {
+	case scm.ActionClose, scm.ActionMerge, scm.ActionDelete:
+		return true
+	}
+	return pr.PullRequest.Closed || pr.PullRequest.Merged
+}
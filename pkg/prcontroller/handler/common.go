@@ -1,23 +1,47 @@
 package handler
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Response is the JSON body written in reply to a webhook, describing what the controller did so
+// that the delivery history of the webhook can be used as an audit trail.
+type Response struct {
+	Message    string     `json:"message"`
+	Event      string     `json:"event,omitempty"`
+	Action     string     `json:"action,omitempty"`
+	Repository string     `json:"repository,omitempty"`
+	Number     int        `json:"number,omitempty"`
+	Matched    []Resource `json:"matched,omitempty"`
+	Resources  Results    `json:"resources,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Resource identifies a Kubernetes resource.
+type Resource struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
 func ResponseHTTPError(w http.ResponseWriter, statusCode int, response string) {
-	logrus.WithFields(logrus.Fields{
-		"response":    response,
-		"status-code": statusCode,
-	}).Info(response)
-	http.Error(w, response, statusCode)
+	ResponseHTTP(w, statusCode, Response{Message: response, Error: response})
 }
 
-func ResponseHTTP(w http.ResponseWriter, statusCode int, response string) {
+func ResponseHTTP(w http.ResponseWriter, statusCode int, response Response) {
 	logrus.WithFields(logrus.Fields{
-		"response":    response,
+		"response":    response.Message,
 		"status-code": statusCode,
-	}).Info(response)
-	http.Error(w, response, statusCode)
+	}).Info(response.Message)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logrus.Errorf("unable to write response: %v", err)
+	}
 }
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"sort"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/jenkins-x/go-scm/scm"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Pair is a base kind and a pull request kind created for its resources.
+type Pair struct {
+	Base        defines.GroupVersionResourceKind
+	PullRequest defines.GroupVersionResourceKind
+	// Conventional is true if the kinds are paired by their names, e.g. Example -> ExamplePullRequest,
+	// rather than only by a mapping.
+	Conventional bool
+}
+
+// Pairs pairs the base kinds with their pull request kinds, by name and by the mappings.
+func Pairs(kinds []defines.GroupVersionResourceKind, mappings []defines.Mapping) []Pair {
+	var pairs []Pair
+	for k, v := range ToMap(kinds) {
+		pairs = append(pairs, Pair{Base: k, PullRequest: v, Conventional: true})
+	}
+
+	for _, m := range mappings {
+		if !contains(kinds, m.Base) || containsPair(pairs, m.Base, m.PullRequest) {
+			continue
+		}
+		pairs = append(pairs, Pair{Base: m.Base, PullRequest: m.PullRequest})
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Base.Kind+"/"+pairs[i].PullRequest.Kind < pairs[j].Base.Kind+"/"+pairs[j].PullRequest.Kind
+	})
+	return pairs
+}
+
+// Mapping returns the mapping for the pair that applies to base resources in the namespace, preferring
+// a PullRequestMapping in the namespace to a ClusterPullRequestMapping.
+func (p Pair) Mapping(mappings []defines.Mapping, namespace string) *defines.Mapping {
+	var cluster *defines.Mapping
+	for i, m := range mappings {
+		if m.Base != p.Base || m.PullRequest != p.PullRequest {
+			continue
+		}
+		if m.Namespace == namespace {
+			return &mappings[i]
+		}
+		if m.Namespace == "" && cluster == nil {
+			cluster = &mappings[i]
+		}
+	}
+	return cluster
+}
+
+// Applies returns true if pull request resources are created for base resources in the namespace.
+func (p Pair) Applies(mappings []defines.Mapping, namespace string) bool {
+	return p.Conventional || p.Mapping(mappings, namespace) != nil
+}
+
+// render applies a mapping to a pull request resource, keeping the identity, provenance and source
+// of the resource set by the controller.
+func render(u *unstructured.Unstructured, m *defines.Mapping, base unstructured.Unstructured, pr *scm.PullRequestHook, layout defines.SourceLayout) error {
+	labels := make([]string, 0, len(pr.PullRequest.Labels))
+	for _, l := range pr.PullRequest.Labels {
+		if l != nil {
+			labels = append(labels, l.Name)
+		}
+	}
+
+	fields, err := m.Render(defines.TemplateContext{
+		PullRequest: defines.PullRequestContext{
+			Number:     pr.PullRequest.Number,
+			Title:      defines.Quoted(pr.PullRequest.Title),
+			URL:        defines.Quoted(pr.PullRequest.Link),
+			Author:     defines.Quoted(pr.PullRequest.Author.Login),
+			Labels:     defines.Strings(labels),
+			HeadRef:    defines.Quoted(headRef(pr)),
+			BaseRef:    defines.Quoted(pr.PullRequest.Target),
+			Sha:        defines.Quoted(pr.PullRequest.Sha),
+			Repository: defines.Quoted(Repository(pr)),
+			CloneURL:   defines.Quoted(pr.Repo.Clone),
+		},
+		Base: base.DeepCopy().Object,
+	})
+	if err != nil {
+		return err
+	}
+
+	name, namespace := u.GetName(), u.GetNamespace()
+	apiVersion, kind := u.GetAPIVersion(), u.GetKind()
+	labelValues, annotations, owners := u.GetLabels(), u.GetAnnotations(), u.GetOwnerReferences()
+	source := sourceFields(u, layout)
+
+	defines.Merge(u.Object, fields)
+
+	u.SetName(name)
+	u.SetNamespace(namespace)
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetLabels(merge(u.GetLabels(), labelValues))
+	u.SetAnnotations(merge(u.GetAnnotations(), annotations))
+	u.SetOwnerReferences(owners)
+	// the template can't point the resource at another repository or commit
+	for _, f := range source {
+		if !f.found {
+			unstructured.RemoveNestedField(u.Object, f.path...)
+			continue
+		}
+		if err := unstructured.SetNestedField(u.Object, f.value, f.path...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field is a copy of the value of a field of a resource.
+type field struct {
+	path  []string
+	value interface{}
+	found bool
+}
+
+// sourceFields returns a copy of the fields containing the git source of the resource.
+func sourceFields(u *unstructured.Unstructured, layout defines.SourceLayout) []field {
+	var fields []field
+	for _, path := range layout.Fields(u) {
+		value, found, _ := unstructured.NestedFieldCopy(u.Object, path...)
+		fields = append(fields, field{path: path, value: value, found: found})
+	}
+	return fields
+}
+
+func contains(kinds []defines.GroupVersionResourceKind, gvrk defines.GroupVersionResourceKind) bool {
+	for _, k := range kinds {
+		if k == gvrk {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPair(pairs []Pair, base defines.GroupVersionResourceKind, pr defines.GroupVersionResourceKind) bool {
+	for _, p := range pairs {
+		if p.Base == base && p.PullRequest == pr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+)
+
+// ChangedFiles lazily lists the files changed by a pull request, so the SCM is only called when a
+// matched base resource is built from a subset of the repository.
+type ChangedFiles struct {
+	pr *scm.PullRequestHook
+
+	loaded bool
+	files  []string
+	err    error
+}
+
+// NewChangedFiles creates the ChangedFiles of the pull request.
+func NewChangedFiles(pr *scm.PullRequestHook) *ChangedFiles {
+	return &ChangedFiles{pr: pr}
+}
+
+// list returns the paths of the changed files, including the previous paths of renamed files.
+func (c *ChangedFiles) list(ctx context.Context) ([]string, error) {
+	if !c.loaded {
+		c.loaded = true
+		c.files, c.err = c.load(ctx)
+		if c.err != nil {
+			logrus.Warnf("unable to list the files changed by PR-%d, not filtering by path: %v", c.pr.PullRequest.Number, c.err)
+		}
+	}
+	return c.files, c.err
+}
+
+func (c *ChangedFiles) load(ctx context.Context) ([]string, error) {
+	client, repo, err := scmclient.ForURL(c.pr.Repo.Clone)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	opts := &scm.ListOptions{Page: 1, Size: 100}
+	for {
+		changes, res, err := client.PullRequests.ListChanges(ctx, repo, c.pr.PullRequest.Number, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			files = append(files, change.Path)
+			if change.PreviousPath != "" && change.PreviousPath != change.Path {
+				files = append(files, change.PreviousPath)
+			}
+		}
+		if res == nil || res.Page.Next == 0 {
+			return files, nil
+		}
+		opts.Page = res.Page.Next
+	}
+}
+
+// Changed returns true if the pull request changes a file matching the globs. If the changed files
+// cannot be listed every base resource is treated as changed.
+func (c *ChangedFiles) Changed(ctx context.Context, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+
+	files, err := c.list(ctx)
+	if err != nil {
+		return true
+	}
+	return defines.MatchesPaths(globs, files)
+}
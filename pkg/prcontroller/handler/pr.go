@@ -4,205 +4,540 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	"github.com/jenkins-x/go-scm/scm"
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 )
 
+// HandleTimeout is how long handling a pull request event may take.
+const HandleTimeout = 2 * time.Minute
+
 var (
 	Dynamic   dynamic.Interface
 	Discovery discovery.DiscoveryInterface
+	Mapper    *defines.Mapper
+	Cache     *cache.Cache
+
+	setupLock  sync.Mutex
+	setupFuncs []func()
 )
 
-func PullRequest(pr *scm.PullRequestHook, w http.ResponseWriter) {
-	logrus.Infof("handling %s for PR-%d", pr.Action, pr.PullRequest.Number)
-	logrus.Debugf("%+v", pr)
+// OnSetup calls f once the workload cache has started, immediately if it already has.
+func OnSetup(f func()) {
+	setupLock.Lock()
+	started := Cache != nil
+	if !started {
+		setupFuncs = append(setupFuncs, f)
+	}
+	setupLock.Unlock()
+
+	if started {
+		f()
+	}
+}
+
+// Setup creates any clients that have not already been configured and starts the workload cache,
+// then calls the functions registered with OnSetup. It is safe to call from concurrent workers, only
+// one of which starts the cache.
+func Setup() error {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+
+	if err := clients(); err != nil {
+		return err
+	}
+
+	if Mapper == nil {
+		Mapper = defines.NewMapper(Discovery)
+	}
+
+	if Cache == nil {
+		c := cache.New(Dynamic, Mapper, 10*time.Minute)
+		if err := c.Start(context.Background()); err != nil {
+			return fmt.Errorf("unable to start cache: %w", err)
+		}
+		Cache = c
+
+		for _, f := range setupFuncs {
+			f()
+		}
+		setupFuncs = nil
+	}
 
-	ctx := context.Background()
+	return nil
+}
 
-	if Dynamic == nil {
+// Clients creates any clients that have not already been configured, without starting the workload
+// cache.
+func Clients() error {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+
+	return clients()
+}
+
+func clients() error {
+	if Dynamic == nil || Discovery == nil {
 		// can we locate a workload for this hook?
 		config, err := rest.InClusterConfig()
 		if err != nil {
-			logrus.Errorf("Unable to load config: %v", err)
-			ResponseHTTPError(w, 500, fmt.Sprintf("Unable to load config: %v", err))
-			return
+			return fmt.Errorf("unable to load config: %w", err)
 		}
 
-		Dynamic, err = dynamic.NewForConfig(config)
-		if err != nil {
-			logrus.Errorf("Unable to get dynamic client: %v", err)
-			ResponseHTTPError(w, 500, fmt.Sprintf("Unable to get dynamic client: %v", err))
-			return
+		if Dynamic == nil {
+			Dynamic, err = dynamic.NewForConfig(config)
+			if err != nil {
+				return fmt.Errorf("unable to get dynamic client: %w", err)
+			}
+		}
+
+		if Discovery == nil {
+			Discovery, err = discovery.NewDiscoveryClientForConfig(config)
+			if err != nil {
+				return fmt.Errorf("unable to get discovery client: %w", err)
+			}
 		}
 	}
 
-	supplyChainList, err := Dynamic.Resource(schema.GroupVersionResource{
-		Group:    "supply-chain.apps.tanzu.vmware.com",
-		Version:  "v1alpha1",
-		Resource: "supplychains",
-	}).List(ctx, v1.ListOptions{})
-	if err != nil {
-		logrus.Errorf("Unable to get supply chains: %v", err)
-		ResponseHTTPError(w, 500, fmt.Sprintf("Unable to get supply chains: %v", err))
-		return
+	return nil
+}
+
+// Handle creates, updates or deletes the pull request resources for every workload matching the
+// pull request, returning the HTTP status code and response describing what was done.
+func Handle(ctx context.Context, driver string, pr *scm.PullRequestHook) (int, Response) {
+	logrus.Infof("handling %s for PR-%d", pr.Action, pr.PullRequest.Number)
+	logrus.Debugf("%+v", pr)
+
+	response := Response{
+		Message:    "PR Accepted",
+		Event:      string(scm.WebhookKindPullRequest),
+		Action:     pr.Action.String(),
+		Repository: Repository(pr),
+		Number:     pr.PullRequest.Number,
+	}
+
+	op := operationFor(pr)
+	if op == operationIgnore {
+		logrus.Infof("ignoring %s for PR-%d", pr.Action, pr.PullRequest.Number)
+		response.Message = "PR Ignored"
+		return http.StatusAccepted, response
 	}
 
-	kinds := make([]defines.GroupVersionResourceKind, len(supplyChainList.Items))
-	for i, t := range supplyChainList.Items {
-		kinds[i] = defines.Workload(t)
+	if err := Setup(); err != nil {
+		logrus.Errorf("Unable to create clients: %v", err)
+		response.Message = "Unable to create clients"
+		response.Error = err.Error()
+		return http.StatusInternalServerError, response
 	}
 
 	// we need to locate all types that have a corresponding *PullRequest type
-	mappedGrs := ToMap(kinds)
+	mappings := Cache.Mappings()
+	pairs := Pairs(Cache.Kinds(), mappings)
 
-	logrus.Debugf("mapped GroupResources %s", mappedGrs)
+	logrus.Debugf("paired kinds %+v", pairs)
 
 	logrus.Infof("seaching for resources for git url %s and target branch %s", strings.TrimSuffix(pr.Repo.Clone, ".git"), pr.PullRequest.Target)
 
-	for k, v := range mappedGrs {
+	files := NewChangedFiles(pr)
+
+	for _, p := range pairs {
+		k, v := p.Base, p.PullRequest
 		logrus.Infof("%s -> %s", k.Kind, v.Kind)
 
-		mainBranchResources, err := Dynamic.Resource(k.ToGroupVersionResource()).List(context.Background(), v1.ListOptions{
-			LabelSelector: "",
-		})
+		mainBranchResources, err := Cache.Lookup(ctx, k, pr.Repo.Clone, pr.PullRequest.Target)
 		if err != nil {
-			ResponseHTTPError(w, 500, fmt.Sprintf("%v", err))
-			return
-		}
-
-		logrus.Infof("Found %d resources for %s", len(mainBranchResources.Items), k.Kind)
-
-		found := false
-
-		for _, mainBranchResource := range mainBranchResources.Items {
-			// we assume that the source is structured how we think...
-			gitURL, _, _ := unstructured.NestedString(mainBranchResource.Object, "spec", "source", "git", "url")
-			branch, _, _ := unstructured.NestedString(mainBranchResource.Object, "spec", "source", "git", "branch")
-
-			// if the gitURL match
-			if strings.TrimSuffix(pr.Repo.Clone, ".git") == strings.TrimSuffix(gitURL, ".git") && pr.PullRequest.Target == branch {
-				logrus.Infof("Found matching %s for url %s", mainBranchResources.GetKind(), gitURL)
-				found = true
-				u := convertToPullRequestType(mainBranchResource, v, pr)
-
-				switch pr.Action.String() {
-				case "create", "updated", "opened", "reopened":
-					if pr.PullRequest.Draft {
-						deleteIfExists(Dynamic, u, w, v)
-						return
-					}
-					createOrUpdate(Dynamic, u, w, v)
-					return
-				case "merged", "closed":
-					deleteIfExists(Dynamic, u, w, v)
-					return
-				default:
-					logrus.Warnf("unhandled action %s", pr.Action)
+			logrus.Errorf("unable to find %s resources: %v", k.Kind, err)
+			response.Resources = append(response.Resources, Result{Resource: Resource{Kind: v.Kind}, Action: ActionFailed, Error: err})
+			continue
+		}
+
+		logrus.Infof("Found %d resources for %s", len(mainBranchResources), k.Kind)
+
+		for _, mainBranchResource := range mainBranchResources {
+			if !p.Applies(mappings, mainBranchResource.GetNamespace()) {
+				continue
+			}
+
+			source := Cache.Options(k).Source().Read(mainBranchResource)
+			logrus.Infof("Found matching %s %s/%s for url %s", k.Kind, mainBranchResource.GetNamespace(), mainBranchResource.GetName(), source.URL)
+
+			base := Resource{Kind: k.Kind, Namespace: mainBranchResource.GetNamespace(), Name: mainBranchResource.GetName()}
+			if !containsResource(response.Matched, base) {
+				response.Matched = append(response.Matched, base)
+			}
+
+			u := convertToPullRequestType(*mainBranchResource, k, v, driver, pr, Cache.Options(v))
+			if !Cache.Options(k).DisableOwnerReferences && !Cache.Options(v).DisableOwnerReferences {
+				u.SetOwnerReferences(ownerReferences(*mainBranchResource))
+			}
+
+			if m := p.Mapping(mappings, mainBranchResource.GetNamespace()); m != nil {
+				if err := render(&u, m, *mainBranchResource, pr, Cache.Options(v).Source()); err != nil {
+					logrus.Errorf("unable to render %s for %s/%s: %v", v.Kind, mainBranchResource.GetNamespace(), mainBranchResource.GetName(), err)
+					response.Resources = append(response.Resources, Result{
+						Resource: Resource{Kind: v.Kind, Namespace: u.GetNamespace(), Name: u.GetName()},
+						Base:     &base,
+						Action:   ActionFailed,
+						Error:    err,
+					})
+					continue
 				}
 			}
+
+			var result Result
+			switch {
+			case op == operationDelete:
+				result = deleteIfExists(ctx, Dynamic, u, v, closedOrMerged(pr))
+			// resources for drafts, or for base resources built from paths the pull request doesn't change, are removed
+			case pr.PullRequest.Draft || !files.Changed(ctx, defines.Paths(mainBranchResource, source)):
+				result = deleteIfExists(ctx, Dynamic, u, v, false)
+			default:
+				result = createOrUpdate(ctx, Dynamic, u, v)
+			}
+
+			result.Base = &base
+			response.Resources = append(response.Resources, result)
 		}
 
-		if !found {
+		if len(mainBranchResources) == 0 {
 			logrus.Infof("couldn't find a matching %s resource for PR-%d", k.Kind, pr.PullRequest.Number)
 		}
+
+		if previous, ok := previousTarget(pr); ok {
+			response.Resources = append(response.Resources, deletePreviousTarget(ctx, driver, pr, p, mappings, previous)...)
+		}
+	}
+
+	sort.SliceStable(response.Matched, func(i, j int) bool {
+		return key(response.Matched[i]) < key(response.Matched[j])
+	})
+	response.Resources.Sort()
+
+	if response.Resources.Failed() {
+		response.Message = "PR Failed"
+		response.Error = "unable to handle all pull request resources"
+		return http.StatusInternalServerError, response
 	}
 
-	ResponseHTTP(w, http.StatusAccepted, "PR Accepted")
+	return http.StatusAccepted, response
+}
+
+// previousTarget returns the branch the pull request targeted before it was retargeted by the event.
+// Only GitHub reports it, the resources for the previous target of other drivers are removed by a resync.
+func previousTarget(pr *scm.PullRequestHook) (string, bool) {
+	previous := pr.Changes.Base.Ref.From
+	return previous, previous != "" && previous != pr.PullRequest.Target
 }
 
-func deleteIfExists(d dynamic.Interface, u unstructured.Unstructured, w http.ResponseWriter, v defines.GroupVersionResourceKind) {
+// deletePreviousTarget deletes the pull request resources derived from the base resources for the
+// branch the pull request previously targeted.
+func deletePreviousTarget(ctx context.Context, driver string, pr *scm.PullRequestHook, p Pair, mappings []defines.Mapping, previous string) []Result {
+	k, v := p.Base, p.PullRequest
+	logrus.Infof("PR-%d was retargeted from %s to %s, removing its %s resources for %s", pr.PullRequest.Number, previous, pr.PullRequest.Target, v.Kind, previous)
+
+	resources, err := Cache.Lookup(ctx, k, pr.Repo.Clone, previous)
+	if err != nil {
+		logrus.Errorf("unable to find %s resources for %s: %v", k.Kind, previous, err)
+		return []Result{{Resource: Resource{Kind: v.Kind}, Action: ActionFailed, Error: err}}
+	}
+
+	var results []Result
+	for _, resource := range resources {
+		if !p.Applies(mappings, resource.GetNamespace()) {
+			continue
+		}
+
+		base := Resource{Kind: k.Kind, Namespace: resource.GetNamespace(), Name: resource.GetName()}
+		u := convertToPullRequestType(*resource, k, v, driver, pr, Cache.Options(v))
+
+		result := deleteIfExists(ctx, Dynamic, u, v, false)
+		result.Base = &base
+		results = append(results, result)
+	}
+	return results
+}
+
+// Delete deletes a pull request resource of the pull request found outside of a webhook, e.g. by a
+// resync, recording a tombstone at the time the pull request was last updated as the events that delete
+// it do.
+func Delete(ctx context.Context, d dynamic.Interface, pr *scm.PullRequestHook, v defines.GroupVersionResourceKind, obj *unstructured.Unstructured) Result {
+	u := obj.DeepCopy()
+	if !pr.PullRequest.Updated.IsZero() {
+		u.SetAnnotations(merge(u.GetAnnotations(), map[string]string{
+			defines.UpdatedAnnotation: defines.FormatUpdated(pr.PullRequest.Updated),
+		}))
+	}
+	return deleteIfExists(ctx, d, *u, v, closedOrMerged(pr))
+}
+
+// deleteIfExists deletes the pull request resource, recording a tombstone so that an older event that
+// arrives late does not recreate it. When the pull request was closed or merged a tombstone is recorded
+// even if the resource doesn't exist, e.g. when the closed event arrives before the opened.
+func deleteIfExists(ctx context.Context, d dynamic.Interface, u unstructured.Unstructured, v defines.GroupVersionResourceKind, closed bool) Result {
 	logrus.Infof("Delete handler: %s", u.GetName())
 
+	result := Result{Resource: Resource{Kind: v.Kind, Namespace: u.GetNamespace(), Name: u.GetName()}, Action: ActionUnchanged}
+
+	updated, hasUpdated := defines.UpdatedAt(&u)
+
 	// we should check if this resource already exists
-	got, err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Get(context.Background(), u.GetName(), v1.GetOptions{})
+	got, err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Get(ctx, u.GetName(), v1.GetOptions{})
 	if err != nil {
-		logrus.Infof("unable to determine if %s exists: %v", u.GetName(), err)
+		if apierrors.IsNotFound(err) {
+			logrus.Infof("%s does not exist", u.GetName())
+			if closed && hasUpdated {
+				if err := Tombstones.Add(ctx, result.Resource, updated); err != nil {
+					logrus.Errorf("unable to record that %s was deleted: %v", u.GetName(), err)
+				}
+			}
+			return result
+		}
+		logrus.Errorf("unable to determine if %s exists: %v", u.GetName(), err)
+		result.Action = ActionFailed
+		result.Error = err
+		return result
 	}
 
-	if got != nil {
-		logrus.Infof("Deleting resource: %s\n", u.GetName())
-		err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Delete(context.Background(), got.GetName(), v1.DeleteOptions{})
-		if err != nil {
-			logrus.Errorf("unable to delete %s: %v", got.GetName(), err)
-			ResponseHTTPError(w, 500, fmt.Sprintf("%v", err))
-			return
+	if !defines.IsManaged(got) {
+		logrus.Warnf("refusing to delete %s, it was not created by %s", got.GetName(), defines.ManagedBy)
+		result.Action = ActionSkipped
+		result.Error = fmt.Errorf("not managed by %s", defines.ManagedBy)
+		return result
+	}
+
+	if outOfOrder(&u, got) {
+		result.Action = ActionIgnored
+		return result
+	}
+
+	logrus.Infof("Deleting resource: %s", u.GetName())
+	err = d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Delete(ctx, got.GetName(), v1.DeleteOptions{})
+	if err != nil {
+		logrus.Errorf("unable to delete %s: %v", got.GetName(), err)
+		result.Action = ActionFailed
+		result.Error = err
+		return result
+	}
+	logrus.Infof("Deleted resource: %s", got.GetName())
+	if hasUpdated {
+		if err := Tombstones.Add(ctx, result.Resource, updated); err != nil {
+			logrus.Errorf("unable to record that %s was deleted: %v", got.GetName(), err)
 		}
-		logrus.Infof("Deleted resource: %s\n", got.GetName())
 	}
 
-	ResponseHTTP(w, http.StatusCreated, "Resource Deleted")
+	result.Action = ActionDeleted
+	return result
 }
 
-func createOrUpdate(d dynamic.Interface, u unstructured.Unstructured, w http.ResponseWriter, v defines.GroupVersionResourceKind) {
+// FieldManager is the field manager the pull request resources are applied with, the controller only
+// owns the fields it sets so fields set by other controllers or users are left alone.
+const FieldManager = "pr-controller"
+
+func createOrUpdate(ctx context.Context, d dynamic.Interface, u unstructured.Unstructured, v defines.GroupVersionResourceKind) Result {
 	logrus.Infof("CreateOrUpdate handler: %s", u.GetName())
 
-	// we should check if this resource already exists
-	got, err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Get(context.Background(), u.GetName(), v1.GetOptions{})
+	result := Result{Resource: Resource{Kind: v.Kind, Namespace: u.GetNamespace(), Name: u.GetName()}}
+
+	// conflicting writes, e.g. from concurrent events or other controllers, are retried with a fresh read
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		action, err := tryCreateOrUpdate(ctx, d, u, v, result.Resource)
+		if apierrors.IsConflict(err) {
+			logrus.Infof("%s was modified, retrying: %v", u.GetName(), err)
+		}
+		result.Action = action
+		return err
+	})
 	if err != nil {
-		logrus.Infof("unable to determine if %s exists: %v", u.GetName(), err)
+		result.Error = err
+		if result.Action == ActionSkipped {
+			return result
+		}
+		logrus.Errorf("unable to create or update %s: %v", u.GetName(), err)
+		result.Action = ActionFailed
 	}
+	return result
+}
 
-	if got == nil {
-		logrus.Infof("Creating new resource: %+v", u)
-		create, err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Create(context.Background(), &u, v1.CreateOptions{})
-		if err != nil {
-			logrus.Errorf("unable to create %s: %v", got.GetName(), err)
-			ResponseHTTPError(w, 500, fmt.Sprintf("%v", err))
-			return
+// tryCreateOrUpdate applies the desired state of the resource with server-side apply, returning the
+// action taken.
+func tryCreateOrUpdate(ctx context.Context, d dynamic.Interface, u unstructured.Unstructured, v defines.GroupVersionResourceKind, r Resource) (string, error) {
+	// we should check if this resource already exists
+	got, err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Get(ctx, u.GetName(), v1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ActionFailed, fmt.Errorf("unable to determine if %s exists: %w", u.GetName(), err)
+	}
+
+	action := ActionUpdated
+	if apierrors.IsNotFound(err) {
+		if updated, ok := defines.UpdatedAt(&u); ok {
+			deleted, ok, err := Tombstones.Get(ctx, r)
+			if err != nil {
+				return ActionFailed, fmt.Errorf("unable to determine if %s was deleted: %w", u.GetName(), err)
+			}
+			if ok && updated.Before(deleted) {
+				logrus.Infof("ignoring event for %s, the pull request was updated at %s but it was deleted by an event at %s", u.GetName(), updated, deleted)
+				return ActionIgnored, nil
+			}
 		}
-		logrus.Infof("Created new resource: %s", create.GetName())
+		action = ActionCreated
 	} else {
-		logrus.Infof("Updating resource: %s", got.GetName())
-		branch, _, _ := unstructured.NestedString(u.UnstructuredContent(), "spec", "source", "git", "branch")
-		_ = unstructured.SetNestedField(got.UnstructuredContent(), branch, "spec", "source", "git", "branch")
+		if !defines.IsManaged(got) {
+			logrus.Warnf("refusing to update %s, it was not created by %s", got.GetName(), defines.ManagedBy)
+			return ActionSkipped, fmt.Errorf("not managed by %s", defines.ManagedBy)
+		}
+		if outOfOrder(&u, got) {
+			return ActionIgnored, nil
+		}
+		// the apply fails with a conflict if the resource has changed since it was read
+		u.SetResourceVersion(got.GetResourceVersion())
+	}
 
-		commit, _, _ := unstructured.NestedString(u.UnstructuredContent(), "spec", "source", "git", "commit")
-		_ = unstructured.SetNestedField(got.UnstructuredContent(), commit, "spec", "source", "git", "commit")
+	logrus.Infof("Applying resource: %s", u.GetName())
+	applied, err := d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Apply(ctx, u.GetName(), &u, v1.ApplyOptions{
+		FieldManager: FieldManager,
+		Force:        true,
+	})
+	if err != nil {
+		return ActionFailed, err
+	}
+	logrus.Infof("Applied resource: %s", applied.GetName())
 
-		_, err = d.Resource(v.ToGroupVersionResource()).Namespace(u.GetNamespace()).Update(context.Background(), got, v1.UpdateOptions{})
-		if err != nil {
-			logrus.Errorf("unable to update %s: %v", got.GetName(), err)
-			ResponseHTTPError(w, 500, fmt.Sprintf("%v", err))
-			return
+	if action == ActionCreated {
+		if err := Tombstones.Remove(ctx, r); err != nil {
+			logrus.Errorf("unable to forget that %s was deleted: %v", applied.GetName(), err)
 		}
 	}
+	return action, nil
+}
 
-	ResponseHTTP(w, http.StatusCreated, "Resource Created")
+// outOfOrder returns true if the event the resource was converted from is for an older update of the
+// pull request than the event applied to the existing resource.
+func outOfOrder(u *unstructured.Unstructured, existing *unstructured.Unstructured) bool {
+	updated, ok := defines.UpdatedAt(u)
+	if !ok {
+		return false
+	}
+	applied, ok := defines.UpdatedAt(existing)
+	if !ok || updated.After(applied) || updated.Equal(applied) {
+		return false
+	}
+	logrus.Infof("ignoring event for %s, the pull request was updated at %s but an event at %s has been applied", u.GetName(), updated, applied)
+	return true
 }
 
-func convertToPullRequestType(resource unstructured.Unstructured, gvrk defines.GroupVersionResourceKind, pr *scm.PullRequestHook) unstructured.Unstructured {
-	return unstructured.Unstructured{
+func convertToPullRequestType(resource unstructured.Unstructured, base defines.GroupVersionResourceKind, gvrk defines.GroupVersionResourceKind, driver string, pr *scm.PullRequestHook, options defines.Options) unstructured.Unstructured {
+	spec, _, _ := unstructured.NestedMap(resource.Object, "spec")
+	spec = defines.CopySpec(spec, options.SpecInclude, options.SpecExclude)
+
+	u := unstructured.Unstructured{
 		Object: map[string]interface{}{
-			"apiVersion": resource.GetAPIVersion(),
+			// the pull request kind may be in a different group or version to the base kind
+			"apiVersion": gvrk.ToGroupVersionKind().GroupVersion().String(),
 			"kind":       gvrk.Kind,
 			"metadata": map[string]interface{}{
-				"name":      fmt.Sprintf("%s-pr-%d", resource.GetName(), pr.PullRequest.Number),
+				"name":      defines.PullRequestName(resource.GetName(), pr.PullRequest.Number),
 				"namespace": resource.GetNamespace(),
 			},
-			"spec": map[string]interface{}{
-				"source": map[string]interface{}{
-					"git": map[string]interface{}{
-						"url":    pr.Repo.Clone,
-						"branch": pr.PullRequest.Head.Ref,
-						"commit": pr.PullRequest.Sha,
-					},
-				},
-			},
-			// TODO at some point we will want to consider some kind of additional mapping here.
-			// for example, how do we set extra properties that are required for tests
+			"spec": spec,
 		},
 	}
+
+	u.SetLabels(merge(defines.CopyMetadata(resource.GetLabels(), options.CopyLabels), map[string]string{
+		defines.ManagedByLabel:  defines.ManagedBy,
+		defines.DriverLabel:     defines.LabelValue(driver),
+		defines.RepositoryLabel: defines.LabelValue(Repository(pr)),
+		defines.NumberLabel:     strconv.Itoa(pr.PullRequest.Number),
+	}))
+	u.SetAnnotations(merge(defines.CopyMetadata(resource.GetAnnotations(), options.CopyAnnotations), map[string]string{
+		defines.RepositoryAnnotation: Repository(pr),
+		defines.ShaAnnotation:        pr.PullRequest.Sha,
+		defines.AuthorAnnotation:     pr.PullRequest.Author.Login,
+		defines.BaseNameAnnotation:   resource.GetName(),
+		defines.BaseKindAnnotation:   base.Kind,
+	}))
+
+	if !pr.PullRequest.Updated.IsZero() {
+		u.SetAnnotations(merge(u.GetAnnotations(), map[string]string{
+			defines.UpdatedAnnotation: defines.FormatUpdated(pr.PullRequest.Updated),
+		}))
+	}
+
+	// the source of the base resource is replaced with the head of the pull request
+	_ = options.Source().Write(&u, defines.Source{
+		URL:    pr.Repo.Clone,
+		Branch: headRef(pr),
+		Commit: pr.PullRequest.Sha,
+	})
+
+	return u
+}
+
+// Repository returns the full name of the repository of the webhook, not every driver sets it.
+func Repository(hook scm.Webhook) string {
+	repo := hook.Repository()
+	if repo.FullName != "" {
+		return repo.FullName
+	}
+	return scm.Join(repo.Namespace, repo.Name)
+}
+
+// headRef returns the branch of the pull request, not every driver sets the head.
+func headRef(pr *scm.PullRequestHook) string {
+	if pr.PullRequest.Head.Ref != "" {
+		return pr.PullRequest.Head.Ref
+	}
+	return pr.PullRequest.Source
+}
+
+func containsResource(resources []Resource, r Resource) bool {
+	for _, i := range resources {
+		if i == r {
+			return true
+		}
+	}
+	return false
+}
+
+// merge returns the entries of a overwritten by those in b.
+func merge(a map[string]string, b map[string]string) map[string]string {
+	m := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// ownerReferences makes the base resource the owner of its pull request resources, so they are
+// garbage collected when it is deleted.
+func ownerReferences(base unstructured.Unstructured) []v1.OwnerReference {
+	if base.GetUID() == "" {
+		return nil
+	}
+	return []v1.OwnerReference{{
+		APIVersion: base.GetAPIVersion(),
+		Kind:       base.GetKind(),
+		Name:       base.GetName(),
+		UID:        base.GetUID(),
+	}}
 }
 
 func ToMap(in []defines.GroupVersionResourceKind) map[defines.GroupVersionResourceKind]defines.GroupVersionResourceKind {
@@ -224,17 +559,32 @@ func ToMap(in []defines.GroupVersionResourceKind) map[defines.GroupVersionResour
 
 func locatePullRequestResourceForBaseResource(base defines.GroupVersionResourceKind, in []defines.GroupVersionResourceKind) *defines.GroupVersionResourceKind {
 	for _, i := range in {
-		if i.Group == base.Group && !isNotPullRequestResource(i) && matches(base.Resource, i.Resource) {
+		if i.Group == base.Group && !isNotPullRequestResource(i) && matches(base, i) {
 			return &i
 		}
 	}
 	return nil
 }
 
-func matches(base string, resource string) bool {
-	return strings.TrimSuffix(base, "s") == strings.TrimSuffix(strings.TrimSuffix(resource, "prs"), "pullrequests")
+// matches determines if pr is the pull request type for base. Kinds are compared when known, as
+// resources are pluralised and cannot reliably be compared, e.g. policies -> policyprs.
+func matches(base defines.GroupVersionResourceKind, pr defines.GroupVersionResourceKind) bool {
+	if base.Kind != "" && pr.Kind != "" {
+		return strings.EqualFold(base.Kind, trimPullRequestSuffix(pr.Kind))
+	}
+	return strings.TrimSuffix(base.Resource, "s") == trimPullRequestSuffix(pr.Resource)
+}
+
+func trimPullRequestSuffix(s string) string {
+	lower := strings.ToLower(s)
+	for _, suffix := range []string{"pullrequests", "pullrequest", "prs", "pr"} {
+		if strings.HasSuffix(lower, suffix) {
+			return s[:len(s)-len(suffix)]
+		}
+	}
+	return s
 }
 
 func isNotPullRequestResource(i defines.GroupVersionResourceKind) bool {
-	return !strings.HasSuffix(i.Resource, "prs") && !strings.HasSuffix(i.Resource, "pullrequests")
+	return !i.IsPullRequest()
 }
@@ -1,14 +1,49 @@
 package handler_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/garethjevans/pr-controller/pkg/internal/applytest"
+	"github.com/garethjevans/pr-controller/pkg/internal/fixtures"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
 	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
 
 	"github.com/garethjevans/pr-controller/pkg/defines"
 )
 
+var (
+	exampleGVR            = schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "examples"}
+	examplePullRequestGVR = schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "examplepullrequests"}
+	previewGVR            = schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "previews"}
+	environmentGVR        = schema.GroupVersionResource{Group: "preview.example.dev", Version: "v1", Resource: "environments"}
+	mappingGVR            = schema.GroupVersionResource{Group: "pr.apps.tanzu.vmware.com", Version: "v1alpha1", Resource: "pullrequestmappings"}
+	clusterMappingGVR     = schema.GroupVersionResource{Group: "pr.apps.tanzu.vmware.com", Version: "v1alpha1", Resource: "clusterpullrequestmappings"}
+)
+
 func TestToMap(t *testing.T) {
 	type args struct {
 		in []defines.GroupVersionResourceKind
@@ -38,6 +73,30 @@ func TestToMap(t *testing.T) {
 				{Group: "dogfooding.tanzu.broadcom.com", Resource: "carvelpackages"}: {Group: "dogfooding.tanzu.broadcom.com", Resource: "carvelpackageprs"},
 			},
 		},
+		{
+			name: "irregular plurals",
+			args: args{in: []defines.GroupVersionResourceKind{
+				{
+					Group: "example.com", Resource: "policies", Kind: "Policy",
+				},
+				{
+					Group: "example.com", Resource: "policyprs", Kind: "PolicyPR",
+				},
+				{
+					Group: "example.com", Resource: "proxies", Kind: "Proxy",
+				},
+				{
+					Group: "example.com", Resource: "proxypullrequests", Kind: "ProxyPullRequest",
+				},
+				{
+					Group: "other.example.com", Resource: "policyprs", Kind: "PolicyPR",
+				},
+			}},
+			want: map[defines.GroupVersionResourceKind]defines.GroupVersionResourceKind{
+				{Group: "example.com", Resource: "policies", Kind: "Policy"}: {Group: "example.com", Resource: "policyprs", Kind: "PolicyPR"},
+				{Group: "example.com", Resource: "proxies", Kind: "Proxy"}:   {Group: "example.com", Resource: "proxypullrequests", Kind: "ProxyPullRequest"},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -47,3 +106,979 @@ func TestToMap(t *testing.T) {
 		})
 	}
 }
+
+func TestOnSetup(t *testing.T) {
+	setup(t, nil)
+	// the cache hasn't started yet, e.g. because the first attempt failed
+	handler.Cache = nil
+
+	var calls []string
+	handler.OnSetup(func() { calls = append(calls, "before") })
+	if len(calls) != 0 {
+		t.Fatalf("OnSetup() called %v before the cache started", calls)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := handler.Setup(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	handler.OnSetup(func() { calls = append(calls, "after") })
+	if want := []string{"before", "after"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("OnSetup() calls = %v, want %v", calls, want)
+	}
+}
+
+func TestHandleOwnerReferences(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []v1.OwnerReference
+	}{
+		{
+			name: "owned by the base resource",
+			want: []v1.OwnerReference{{APIVersion: "example.com/v1alpha1", Kind: "Example", Name: "go-scm", UID: "1234"}},
+		},
+		{
+			name:        "opted out on the supply chain",
+			annotations: map[string]string{defines.OwnerReferencesAnnotation: "false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.annotations, example("https://github.com/jenkins-x/go-scm", "main"))
+
+			code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+			if code != http.StatusAccepted {
+				t.Fatalf("Handle() = %d, %+v", code, response)
+			}
+
+			got, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.GetOwnerReferences(), tt.want) {
+				t.Errorf("ownerReferences = %v, want %v", got.GetOwnerReferences(), tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleCopiesSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]interface{}
+	}{
+		{
+			name: "copies the spec",
+			want: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm.git", "branch": "feature", "commit": "abc123"},
+				},
+				"params": map[string]interface{}{"test": "true"},
+				"env":    map[string]interface{}{"DEBUG": "false"},
+			},
+		},
+		{
+			name:        "excludes paths",
+			annotations: map[string]string{defines.SpecExcludeAnnotation: "env"},
+			want: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm.git", "branch": "feature", "commit": "abc123"},
+				},
+				"params": map[string]interface{}{"test": "true"},
+			},
+		},
+		{
+			name:        "includes paths",
+			annotations: map[string]string{defines.SpecIncludeAnnotation: "params"},
+			want: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm.git", "branch": "feature", "commit": "abc123"},
+				},
+				"params": map[string]interface{}{"test": "true"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := example("https://github.com/jenkins-x/go-scm", "main")
+			base.SetLabels(map[string]string{"team": "a", defines.ManagedByLabel: "kapp"})
+			base.SetAnnotations(map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"})
+			_ = unstructured.SetNestedField(base.Object, "true", "spec", "params", "test")
+			_ = unstructured.SetNestedField(base.Object, "false", "spec", "env", "DEBUG")
+			setup(t, tt.annotations, base)
+
+			code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+			if code != http.StatusAccepted {
+				t.Fatalf("Handle() = %d, %+v", code, response)
+			}
+
+			got, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec, _, _ := unstructured.NestedMap(got.Object, "spec"); !reflect.DeepEqual(spec, tt.want) {
+				t.Errorf("spec = %v, want %v", spec, tt.want)
+			}
+			if got.GetLabels()[defines.ManagedByLabel] != defines.ManagedBy {
+				t.Errorf("unexpected labels %v", got.GetLabels())
+			}
+		})
+	}
+}
+
+func TestHandleCopiesMetadata(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+	}{
+		{
+			name: "copies nothing by default",
+		},
+		{
+			name: "copies allowed keys",
+			annotations: map[string]string{
+				defines.CopyLabelsAnnotation:      "team, app.kubernetes.io/",
+				defines.CopyAnnotationsAnnotation: "example.com/, kapp.k14s.io/original",
+			},
+			wantLabels:      map[string]string{"team": "a", "app.kubernetes.io/name": "go-scm"},
+			wantAnnotations: map[string]string{"example.com/owner": "platform"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := example("https://github.com/jenkins-x/go-scm", "main")
+			base.SetLabels(map[string]string{
+				"team":                       "a",
+				"app.kubernetes.io/name":     "go-scm",
+				"app.kubernetes.io/instance": "go-scm",
+				"kapp.k14s.io/app":           "1234",
+				defines.ManagedByLabel:       "kapp",
+			})
+			base.SetAnnotations(map[string]string{
+				"example.com/owner":                                "platform",
+				"kapp.k14s.io/original":                            "{}",
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+			})
+			setup(t, tt.annotations, base)
+
+			code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+			if code != http.StatusAccepted {
+				t.Fatalf("Handle() = %d, %+v", code, response)
+			}
+
+			got, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if labels := copied(got.GetLabels()); !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Errorf("copied labels = %v, want %v", labels, tt.wantLabels)
+			}
+			if annotations := copied(got.GetAnnotations()); !reflect.DeepEqual(annotations, tt.wantAnnotations) {
+				t.Errorf("copied annotations = %v, want %v", annotations, tt.wantAnnotations)
+			}
+		})
+	}
+}
+
+// copied returns the labels or annotations that were not set by the pr-controller.
+func copied(m map[string]string) map[string]string {
+	var copied map[string]string
+	for k, v := range m {
+		if k == defines.ManagedByLabel || strings.HasPrefix(k, defines.ManagedBy+"/") {
+			continue
+		}
+		if copied == nil {
+			copied = make(map[string]string)
+		}
+		copied[k] = v
+	}
+	return copied
+}
+
+func TestHandleMapping(t *testing.T) {
+	mapping := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pr.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "PullRequestMapping",
+		"metadata": map[string]interface{}{
+			"name":      "previews",
+			"namespace": "my-namespace",
+		},
+		"spec": map[string]interface{}{
+			"base":        map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Example"},
+			"pullRequest": map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Preview"},
+			"template": `metadata:
+  name: ignored
+  labels:
+    author: {{ .PullRequest.Author }}
+spec:
+  title: {{ toJson .PullRequest.Title }}
+  description: {{ .PullRequest.Title }}
+  branch: {{ .PullRequest.HeadRef }}
+  source:
+    git:
+      url: https://github.com/attacker/go-scm
+      commit: def456
+`,
+		},
+	}}
+
+	other := example("https://github.com/jenkins-x/go-scm", "main")
+	other.SetNamespace("other-namespace")
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"), other, mapping, fixtures.SupplyChain("previews", "Preview"))
+
+	hook := pullRequestHook(scm.ActionOpen)
+	hook.PullRequest.Title = "Add a feature"
+	hook.PullRequest.Author.Login = "octocat"
+
+	code, response := handler.Handle(context.Background(), "github", hook)
+	if code != http.StatusAccepted {
+		t.Fatalf("Handle() = %d, %+v", code, response)
+	}
+
+	var got []string
+	for _, r := range response.Resources {
+		got = append(got, r.String())
+	}
+	want := []string{
+		"created ExamplePullRequest my-namespace/go-scm-pr-416",
+		"created ExamplePullRequest other-namespace/go-scm-pr-416",
+		"created Preview my-namespace/go-scm-pr-416",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Handle() = %v, want %v", got, want)
+	}
+
+	preview, err := handler.Dynamic.Resource(previewGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.GetLabels()["author"] != "octocat" || preview.GetLabels()[defines.ManagedByLabel] != defines.ManagedBy {
+		t.Errorf("unexpected labels %v", preview.GetLabels())
+	}
+	if title, _, _ := unstructured.NestedString(preview.Object, "spec", "title"); title != "Add a feature" {
+		t.Errorf("expected the title to be rendered, got %s", title)
+	}
+	if commit, _, _ := unstructured.NestedString(preview.Object, "spec", "source", "git", "commit"); commit != "abc123" {
+		t.Errorf("expected the source to be set, got %s", commit)
+	}
+	if url, _, _ := unstructured.NestedString(preview.Object, "spec", "source", "git", "url"); url != "https://github.com/jenkins-x/go-scm.git" {
+		t.Errorf("expected the template not to change the source, got %s", url)
+	}
+}
+
+func TestHandleMappingQuotesPullRequestFields(t *testing.T) {
+	mapping := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pr.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "PullRequestMapping",
+		"metadata": map[string]interface{}{
+			"name":      "previews",
+			"namespace": "my-namespace",
+		},
+		"spec": map[string]interface{}{
+			"base":        map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Example"},
+			"pullRequest": map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Preview"},
+			"template": `spec:
+  title: {{ .PullRequest.Title }}
+`,
+		},
+	}}
+
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"), mapping, fixtures.SupplyChain("previews", "Preview"))
+
+	// the title can't add fields to the rendered yaml
+	hook := pullRequestHook(scm.ActionOpen)
+	hook.PullRequest.Title = "Add a feature\n  source:\n    git:\n      url: https://github.com/attacker/go-scm"
+
+	code, response := handler.Handle(context.Background(), "github", hook)
+	if code != http.StatusAccepted {
+		t.Fatalf("Handle() = %d, %+v", code, response)
+	}
+
+	preview, err := handler.Dynamic.Resource(previewGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title, _, _ := unstructured.NestedString(preview.Object, "spec", "title"); title != hook.PullRequest.Title {
+		t.Errorf("expected the title to be rendered as a string, got %s", title)
+	}
+	if url, _, _ := unstructured.NestedString(preview.Object, "spec", "source", "git", "url"); url != "https://github.com/jenkins-x/go-scm.git" {
+		t.Errorf("expected the title not to change the source, got %s", url)
+	}
+}
+
+func TestHandleMappingAcrossGroups(t *testing.T) {
+	mapping := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pr.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "ClusterPullRequestMapping",
+		"metadata": map[string]interface{}{
+			"name": "environments",
+		},
+		"spec": map[string]interface{}{
+			"base":        map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Example"},
+			"pullRequest": map[string]interface{}{"apiVersion": "preview.example.dev/v1", "kind": "Environment"},
+			"template": `spec:
+  branch: {{ .PullRequest.HeadRef }}
+`,
+		},
+	}}
+
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"), mapping)
+
+	code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+	if code != http.StatusAccepted {
+		t.Fatalf("Handle() = %d, %+v", code, response)
+	}
+
+	environment, err := handler.Dynamic.Resource(environmentGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiVersion := environment.GetAPIVersion(); apiVersion != "preview.example.dev/v1" {
+		t.Errorf("apiVersion = %s, want preview.example.dev/v1", apiVersion)
+	}
+	if branch, _, _ := unstructured.NestedString(environment.Object, "spec", "branch"); branch != "feature" {
+		t.Errorf("branch = %s, want feature", branch)
+	}
+}
+
+func TestHandleMappingUndefinedKind(t *testing.T) {
+	// a namespaced mapping cannot create a kind that no supply chain defines
+	mapping := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pr.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "PullRequestMapping",
+		"metadata": map[string]interface{}{
+			"name":      "environments",
+			"namespace": "my-namespace",
+		},
+		"spec": map[string]interface{}{
+			"base":        map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Example"},
+			"pullRequest": map[string]interface{}{"apiVersion": "preview.example.dev/v1", "kind": "Environment"},
+			"template":    "spec: {}\n",
+		},
+	}}
+
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"), mapping)
+
+	code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+	if code != http.StatusAccepted {
+		t.Fatalf("Handle() = %d, %+v", code, response)
+	}
+	for _, r := range response.Resources {
+		if r.Kind == "Environment" {
+			t.Errorf("Handle() = %s, want the mapping to be ignored", r)
+		}
+	}
+
+	if _, err := handler.Dynamic.Resource(environmentGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected go-scm-pr-416 not to be created: %v", err)
+	}
+}
+
+func TestHandleSourceLayout(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        map[string]interface{}
+		want        map[string]interface{}
+	}{
+		{
+			name: "cartographer workload",
+			spec: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm", "ref": map[string]interface{}{"branch": "main"}},
+				},
+			},
+			want: map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{"url": "https://github.com/jenkins-x/go-scm.git", "ref": map[string]interface{}{"branch": "feature", "commit": "abc123"}},
+				},
+			},
+		},
+		{
+			name:        "flux",
+			annotations: map[string]string{defines.SourceLayoutAnnotation: defines.SourceLayoutFlux},
+			spec: map[string]interface{}{
+				"url": "https://github.com/jenkins-x/go-scm.git",
+				"ref": map[string]interface{}{"branch": "main"},
+			},
+			want: map[string]interface{}{
+				"url": "https://github.com/jenkins-x/go-scm.git",
+				"ref": map[string]interface{}{"branch": "feature", "commit": "abc123"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := example("", "")
+			base.Object["spec"] = tt.spec
+			setup(t, tt.annotations, base)
+
+			code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+			if code != http.StatusAccepted || len(response.Resources) != 1 {
+				t.Fatalf("Handle() = %d, %+v", code, response)
+			}
+
+			got, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec, _, _ := unstructured.NestedMap(got.Object, "spec"); !reflect.DeepEqual(spec, tt.want) {
+				t.Errorf("spec = %v, want %v", spec, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlePaths(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/repos/jenkins-x/go-scm/pulls/416/files" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[{"filename": "apps/api/main.go"}, {"filename": "libs/new.go", "previous_filename": "libs/old.go"}]`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	gitURL := s.URL + "/jenkins-x/go-scm"
+	workload := func(name string, subPath string, paths string) *unstructured.Unstructured {
+		w := example(gitURL, "main")
+		w.SetName(name)
+		w.SetUID(types.UID(name))
+		_ = unstructured.SetNestedField(w.Object, subPath, "spec", "source", "subPath")
+		if paths != "" {
+			w.SetAnnotations(map[string]string{defines.PathsAnnotation: paths})
+		}
+		return w
+	}
+
+	// a pull request resource left behind by an earlier push that changed apps/web
+	existing := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1alpha1",
+		"kind":       "ExamplePullRequest",
+		"metadata": map[string]interface{}{
+			"name":      "web-pr-416",
+			"namespace": "my-namespace",
+			"labels":    map[string]interface{}{defines.ManagedByLabel: defines.ManagedBy},
+		},
+	}}
+
+	setup(t, nil,
+		workload("api", "apps/api", ""),
+		workload("web", "apps/web", ""),
+		workload("libs", "", "libs/old.go"),
+		workload("everything", "", ""),
+		existing,
+	)
+
+	hook := pullRequestHook(scm.ActionUpdate)
+	hook.Repo.Clone = gitURL + ".git"
+
+	code, response := handler.Handle(context.Background(), "github", hook)
+	if code != http.StatusAccepted {
+		t.Fatalf("Handle() = %d, %+v", code, response)
+	}
+
+	var got []string
+	for _, r := range response.Resources {
+		got = append(got, r.String())
+	}
+	want := []string{
+		"created ExamplePullRequest my-namespace/api-pr-416",
+		"created ExamplePullRequest my-namespace/everything-pr-416",
+		"created ExamplePullRequest my-namespace/libs-pr-416",
+		"deleted ExamplePullRequest my-namespace/web-pr-416",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Handle() = %v, want %v", got, want)
+	}
+}
+
+func TestHandleActions(t *testing.T) {
+	tests := []struct {
+		action scm.Action
+		closed bool
+		merged bool
+		want   string
+	}{
+		{action: scm.ActionCreate, want: handler.ActionCreated},
+		{action: scm.ActionUpdate, want: handler.ActionCreated},
+		{action: scm.ActionUpdate, closed: true, want: handler.ActionDeleted},
+		{action: scm.ActionDelete, want: handler.ActionDeleted},
+		{action: scm.ActionOpen, want: handler.ActionCreated},
+		{action: scm.ActionReopen, want: handler.ActionCreated},
+		{action: scm.ActionClose, want: handler.ActionDeleted},
+		{action: scm.ActionClose, merged: true, want: handler.ActionDeleted},
+		{action: scm.ActionLabel, want: handler.ActionCreated},
+		{action: scm.ActionUnlabel, want: handler.ActionCreated},
+		{action: scm.ActionSync, want: handler.ActionCreated},
+		{action: scm.ActionMerge, want: handler.ActionDeleted},
+		{action: scm.ActionAssigned},
+		{action: scm.ActionUnassigned},
+		{action: scm.ActionReviewRequested},
+		{action: scm.ActionReviewRequestRemoved},
+		{action: scm.ActionReadyForReview, want: handler.ActionCreated},
+		{action: scm.ActionConvertedToDraft, want: handler.ActionDeleted},
+		{action: scm.ActionEdited, want: handler.ActionCreated},
+		{action: scm.ActionSubmitted},
+		{action: scm.ActionDismissed},
+		{action: scm.ActionCompleted},
+		{action: scm.Action(0)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s closed=%v merged=%v", tt.action, tt.closed, tt.merged), func(t *testing.T) {
+			objects := []runtime.Object{example("https://github.com/jenkins-x/go-scm", "main")}
+			if tt.want == handler.ActionDeleted {
+				objects = append(objects, &unstructured.Unstructured{Object: map[string]interface{}{
+					"apiVersion": "example.com/v1alpha1",
+					"kind":       "ExamplePullRequest",
+					"metadata": map[string]interface{}{
+						"name":      "go-scm-pr-416",
+						"namespace": "my-namespace",
+						"labels":    map[string]interface{}{defines.ManagedByLabel: defines.ManagedBy},
+					},
+				}})
+			}
+			setup(t, nil, objects...)
+			handler.Tombstones = handler.NewMemoryTombstones(handler.DefaultTombstoneTTL)
+
+			pr := pullRequestHook(tt.action)
+			pr.PullRequest.Closed = tt.closed
+			pr.PullRequest.Merged = tt.merged
+
+			code, response := handler.Handle(context.Background(), "github", pr)
+			if code != http.StatusAccepted {
+				t.Fatalf("Handle() = %d, %+v", code, response)
+			}
+			if tt.want == "" {
+				if len(response.Resources) != 0 || response.Message != "PR Ignored" {
+					t.Errorf("Handle() = %s %+v, want the action to be ignored", response.Message, response.Resources)
+				}
+				return
+			}
+			if len(response.Resources) != 1 || response.Resources[0].Action != tt.want {
+				t.Errorf("Handle() = %+v, want %s", response.Resources, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRetargeted(t *testing.T) {
+	release := example("https://github.com/jenkins-x/go-scm", "release-1.2")
+	release.SetName("go-scm-release")
+	release.SetUID("5678")
+
+	setup(t, nil,
+		example("https://github.com/jenkins-x/go-scm", "main"),
+		release,
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1alpha1",
+			"kind":       "ExamplePullRequest",
+			"metadata": map[string]interface{}{
+				"name":      "go-scm-pr-416",
+				"namespace": "my-namespace",
+				"labels":    map[string]interface{}{defines.ManagedByLabel: defines.ManagedBy},
+			},
+		}},
+	)
+
+	pr := pullRequestHook(scm.ActionUpdate)
+	pr.PullRequest.Target = "release-1.2"
+	pr.Changes.Base.Ref.From = "main"
+
+	code, response := handler.Handle(context.Background(), "github", pr)
+	if code != http.StatusAccepted {
+		t.Fatalf("Handle() = %d, %+v", code, response)
+	}
+
+	want := map[string]string{
+		"go-scm-release-pr-416": handler.ActionCreated,
+		"go-scm-pr-416":         handler.ActionDeleted,
+	}
+	if len(response.Resources) != len(want) {
+		t.Fatalf("Handle() = %+v, want %v", response.Resources, want)
+	}
+	for _, r := range response.Resources {
+		if r.Action != want[r.Name] {
+			t.Errorf("%s = %s, want %s", r.Name, r.Action, want[r.Name])
+		}
+	}
+
+	prs := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace")
+	if _, err := prs.Get(context.Background(), "go-scm-pr-416", v1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected go-scm-pr-416 to be deleted: %v", err)
+	}
+	if _, err := prs.Get(context.Background(), "go-scm-release-pr-416", v1.GetOptions{}); err != nil {
+		t.Errorf("expected go-scm-release-pr-416 to be created: %v", err)
+	}
+}
+
+func TestHandleOutOfOrder(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type event struct {
+		action  scm.Action
+		updated time.Time
+		sha     string
+		want    string
+	}
+	tests := []struct {
+		name       string
+		events     []event
+		wantExists bool
+		wantCommit string
+	}{
+		{
+			name: "in order",
+			events: []event{
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionCreated},
+				{action: scm.ActionSync, updated: now.Add(time.Minute), sha: "def456", want: handler.ActionUpdated},
+			},
+			wantExists: true,
+			wantCommit: "def456",
+		},
+		{
+			name: "late update",
+			events: []event{
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionCreated},
+				{action: scm.ActionSync, updated: now.Add(2 * time.Minute), sha: "ghi789", want: handler.ActionUpdated},
+				{action: scm.ActionSync, updated: now.Add(time.Minute), sha: "def456", want: handler.ActionIgnored},
+			},
+			wantExists: true,
+			wantCommit: "ghi789",
+		},
+		{
+			name: "late update in the same second",
+			events: []event{
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionCreated},
+				{action: scm.ActionSync, updated: now.Add(500 * time.Millisecond), sha: "def456", want: handler.ActionUpdated},
+				{action: scm.ActionOpen, updated: now.Add(100 * time.Millisecond), sha: "abc123", want: handler.ActionIgnored},
+			},
+			wantExists: true,
+			wantCommit: "def456",
+		},
+		{
+			name: "late opened after closed",
+			events: []event{
+				{action: scm.ActionClose, updated: now.Add(time.Minute), sha: "abc123", want: handler.ActionUnchanged},
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionIgnored},
+			},
+		},
+		{
+			name: "opened after converted to draft",
+			events: []event{
+				{action: scm.ActionConvertedToDraft, updated: now.Add(time.Minute), sha: "abc123", want: handler.ActionUnchanged},
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionCreated},
+			},
+			wantExists: true,
+			wantCommit: "abc123",
+		},
+		{
+			name: "late closed after reopened",
+			events: []event{
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionCreated},
+				{action: scm.ActionReopen, updated: now.Add(2 * time.Minute), sha: "abc123", want: handler.ActionUpdated},
+				{action: scm.ActionClose, updated: now.Add(time.Minute), sha: "abc123", want: handler.ActionIgnored},
+			},
+			wantExists: true,
+			wantCommit: "abc123",
+		},
+		{
+			name: "reopened after closed",
+			events: []event{
+				{action: scm.ActionOpen, updated: now, sha: "abc123", want: handler.ActionCreated},
+				{action: scm.ActionClose, updated: now.Add(time.Minute), sha: "abc123", want: handler.ActionDeleted},
+				{action: scm.ActionReopen, updated: now.Add(2 * time.Minute), sha: "def456", want: handler.ActionCreated},
+			},
+			wantExists: true,
+			wantCommit: "def456",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"))
+			handler.Tombstones = handler.NewMemoryTombstones(handler.DefaultTombstoneTTL)
+
+			for _, e := range tt.events {
+				pr := pullRequestHook(e.action)
+				pr.PullRequest.Updated = e.updated
+				pr.PullRequest.Sha = e.sha
+
+				code, response := handler.Handle(context.Background(), "github", pr)
+				if code != http.StatusAccepted || len(response.Resources) != 1 {
+					t.Fatalf("Handle(%s) = %d, %+v", e.action, code, response)
+				}
+				if got := response.Resources[0].Action; got != e.want {
+					t.Errorf("Handle(%s at %s) = %s, want %s", e.action, e.updated.Format(time.Kitchen), got, e.want)
+				}
+			}
+
+			got, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+			if exists := err == nil; exists != tt.wantExists {
+				t.Fatalf("exists = %v, want %v: %v", exists, tt.wantExists, err)
+			}
+			if !tt.wantExists {
+				return
+			}
+			if commit, _, _ := unstructured.NestedString(got.Object, "spec", "source", "git", "commit"); commit != tt.wantCommit {
+				t.Errorf("commit = %s, want %s", commit, tt.wantCommit)
+			}
+		})
+	}
+}
+
+func TestHandleOutOfOrderAfterRestart(t *testing.T) {
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"))
+	now := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	handler.Tombstones = handler.NewConfigMapTombstones(handler.Dynamic, "pr-controller", "tombstones", handler.DefaultTombstoneTTL, configmap.DefaultMaxEntries)
+	closed := pullRequestHook(scm.ActionClose)
+	closed.PullRequest.Updated = now.Add(time.Minute)
+	if _, response := handler.Handle(context.Background(), "github", closed); response.Resources[0].Action != handler.ActionUnchanged {
+		t.Fatalf("Handle(closed) = %+v", response)
+	}
+
+	// a new store reading the same ConfigMap, as after a restart or on another replica
+	handler.Tombstones = handler.NewConfigMapTombstones(handler.Dynamic, "pr-controller", "tombstones", handler.DefaultTombstoneTTL, configmap.DefaultMaxEntries)
+	opened := pullRequestHook(scm.ActionOpen)
+	opened.PullRequest.Updated = now
+	if _, response := handler.Handle(context.Background(), "github", opened); response.Resources[0].Action != handler.ActionIgnored {
+		t.Errorf("Handle(opened) = %+v, want %s", response, handler.ActionIgnored)
+	}
+
+	reopened := pullRequestHook(scm.ActionReopen)
+	reopened.PullRequest.Updated = now.Add(2 * time.Minute)
+	if _, response := handler.Handle(context.Background(), "github", reopened); response.Resources[0].Action != handler.ActionCreated {
+		t.Errorf("Handle(reopened) = %+v, want %s", response, handler.ActionCreated)
+	}
+}
+
+func TestHandleCorrectsDrift(t *testing.T) {
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"))
+
+	if _, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen)); response.Resources[0].Action != handler.ActionCreated {
+		t.Fatalf("Handle() = %+v, want %s", response.Resources, handler.ActionCreated)
+	}
+
+	prs := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace")
+	got, err := prs.Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = unstructured.SetNestedField(got.Object, "drifted", "spec", "source", "git", "branch")
+	labels := got.GetLabels()
+	labels[defines.DriverLabel] = "drifted"
+	labels["team"] = "platform"
+	got.SetLabels(labels)
+	got.SetAnnotations(map[string]string{defines.ShaAnnotation: "drifted"})
+	if _, err := prs.Update(context.Background(), got, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionUpdate)); response.Resources[0].Action != handler.ActionUpdated {
+		t.Fatalf("Handle() = %+v, want %s", response.Resources, handler.ActionUpdated)
+	}
+
+	got, err = prs.Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch, _, _ := unstructured.NestedString(got.Object, "spec", "source", "git", "branch"); branch != "feature" {
+		t.Errorf("branch = %s, want feature", branch)
+	}
+	if sha := got.GetAnnotations()[defines.ShaAnnotation]; sha != "abc123" {
+		t.Errorf("sha = %s, want abc123", sha)
+	}
+	if driver := got.GetLabels()[defines.DriverLabel]; driver != "github" {
+		t.Errorf("driver = %s, want github", driver)
+	}
+	if team := got.GetLabels()["team"]; team != "platform" {
+		t.Errorf("team = %s, labels set by others should be kept", team)
+	}
+}
+
+func TestHandleUnmanaged(t *testing.T) {
+	setup(t, nil, example("https://github.com/jenkins-x/go-scm", "main"), &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1alpha1",
+		"kind":       "ExamplePullRequest",
+		"metadata": map[string]interface{}{
+			"name":      "go-scm-pr-416",
+			"namespace": "my-namespace",
+		},
+		"spec": map[string]interface{}{"owner": "someone else"},
+	}})
+
+	code, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+	if code != http.StatusAccepted || len(response.Resources) != 1 || response.Resources[0].Action != handler.ActionSkipped {
+		t.Fatalf("Handle() = %d, %+v, want %s", code, response.Resources, handler.ActionSkipped)
+	}
+
+	got, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defines.IsManaged(got) {
+		t.Errorf("labels = %v, an unmanaged resource should not be taken over", got.GetLabels())
+	}
+	if owner, _, _ := unstructured.NestedString(got.Object, "spec", "owner"); owner != "someone else" {
+		t.Errorf("spec = %v, an unmanaged resource should not be changed", got.Object["spec"])
+	}
+}
+
+func TestHandleConflicts(t *testing.T) {
+	existing := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1alpha1",
+		"kind":       "ExamplePullRequest",
+		"metadata": map[string]interface{}{
+			"name":      "go-scm-pr-416",
+			"namespace": "my-namespace",
+			"labels":    map[string]interface{}{defines.ManagedByLabel: defines.ManagedBy},
+		},
+	}}
+
+	tests := []struct {
+		name      string
+		existing  bool
+		conflicts int
+		want      string
+	}{
+		{name: "update conflict", existing: true, conflicts: 2, want: handler.ActionUpdated},
+		{name: "created concurrently", conflicts: 1, want: handler.ActionCreated},
+		{name: "persistent conflict", existing: true, conflicts: 100, want: handler.ActionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{example("https://github.com/jenkins-x/go-scm", "main")}
+			if tt.existing {
+				objects = append(objects, existing.DeepCopy())
+			}
+
+			attempts := 0
+			setupWithClient(t, nil, func(d *dynamicfake.FakeDynamicClient) {
+				d.PrependReactor("patch", "examplepullrequests", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					attempts++
+					if attempts > tt.conflicts {
+						return false, nil, nil
+					}
+					return true, nil, apierrors.NewConflict(examplePullRequestGVR.GroupResource(), "go-scm-pr-416", errors.New("the object has been modified"))
+				})
+			}, objects...)
+
+			_, response := handler.Handle(context.Background(), "github", pullRequestHook(scm.ActionOpen))
+			if len(response.Resources) != 1 || response.Resources[0].Action != tt.want {
+				t.Fatalf("Handle() = %+v, want %s", response.Resources, tt.want)
+			}
+			if tt.want != handler.ActionFailed && attempts != tt.conflicts+1 {
+				t.Errorf("attempts = %d, want %d", attempts, tt.conflicts+1)
+			}
+			if err := response.Resources[0].Error; err != nil && strings.Count(err.Error(), "Operation cannot be fulfilled") != 1 {
+				t.Errorf("error = %v, want the conflict once", err)
+			}
+		})
+	}
+}
+
+// setup configures the handler with fake clients, a supply chain for Example and
+// ExamplePullRequest and the given objects.
+func setup(t *testing.T, annotations map[string]string, objects ...runtime.Object) {
+	setupWithClient(t, annotations, nil, objects...)
+}
+
+// setupWithClient is setup with a function configuring the fake dynamic client, e.g. adding reactors,
+// which is called before the cache starts using it.
+func setupWithClient(t *testing.T, annotations map[string]string, configure func(d *dynamicfake.FakeDynamicClient), objects ...runtime.Object) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+				{Name: "examplepullrequests", SingularName: "examplepullrequest", Namespaced: true, Kind: "ExamplePullRequest"},
+				{Name: "previews", SingularName: "preview", Namespaced: true, Kind: "Preview"},
+			},
+		},
+		{
+			GroupVersion: "preview.example.dev/v1",
+			APIResources: []v1.APIResource{
+				{Name: "environments", SingularName: "environment", Namespaced: true, Kind: "Environment"},
+			},
+		},
+		{
+			GroupVersion: "pr.apps.tanzu.vmware.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "pullrequestmappings", SingularName: "pullrequestmapping", Namespaced: true, Kind: "PullRequestMapping"},
+				{Name: "clusterpullrequestmappings", SingularName: "clusterpullrequestmapping", Namespaced: false, Kind: "ClusterPullRequestMapping"},
+			},
+		},
+	}
+
+	chain := fixtures.SupplyChain("example-prs", "ExamplePullRequest")
+	chain.SetAnnotations(annotations)
+	objects = append(objects, fixtures.SupplyChain("examples", "Example"), chain)
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR:  "SupplyChainList",
+			exampleGVR:            "ExampleList",
+			examplePullRequestGVR: "ExamplePullRequestList",
+			previewGVR:            "PreviewList",
+			environmentGVR:        "EnvironmentList",
+			mappingGVR:            "PullRequestMappingList",
+			clusterMappingGVR:     "ClusterPullRequestMappingList",
+		},
+		objects...,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	applytest.AddReactor(d)
+	if configure != nil {
+		configure(d)
+	}
+	handler.Dynamic = d
+	handler.Discovery = fakeDiscovery
+	handler.Mapper = defines.NewMapper(fakeDiscovery)
+	handler.Cache = cache.New(d, handler.Mapper, time.Minute)
+	if err := handler.Cache.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func example(gitURL string, branch string) *unstructured.Unstructured {
+	u := fixtures.Example("go-scm", "my-namespace", gitURL, branch)
+	u.SetUID("1234")
+	return u
+}
+
+func pullRequestHook(action scm.Action) *scm.PullRequestHook {
+	return &scm.PullRequestHook{
+		Action: action,
+		Repo:   scm.Repository{FullName: "jenkins-x/go-scm", Clone: "https://github.com/jenkins-x/go-scm.git"},
+		PullRequest: scm.PullRequest{
+			Number: 416,
+			Sha:    "abc123",
+			Target: "main",
+			Head:   scm.PullRequestBranch{Ref: "feature"},
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Actions taken on a pull request resource.
+const (
+	ActionCreated   = "created"
+	ActionUpdated   = "updated"
+	ActionDeleted   = "deleted"
+	ActionUnchanged = "unchanged"
+	ActionSkipped   = "skipped"
+	ActionIgnored   = "ignored"
+	ActionFailed    = "failed"
+)
+
+// Result is the outcome of handling a single pull request resource.
+type Result struct {
+	Resource
+	Base   *Resource
+	Action string
+	Error  error
+	// DryRun is true if the action was not actually taken.
+	DryRun bool
+	// Queued is true if the action will be taken when the queued event is handled.
+	Queued bool
+}
+
+func (r Result) String() string {
+	s := fmt.Sprintf("%s %s %s/%s", r.Action, r.Kind, r.Namespace, r.Name)
+	if r.Error != nil {
+		s = fmt.Sprintf("%s: %v", s, r.Error)
+	}
+	return s
+}
+
+// MarshalJSON writes the result, including the error message if there is one.
+func (r Result) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Resource
+		Base   *Resource `json:"base,omitempty"`
+		Action string    `json:"action"`
+		Error  string    `json:"error,omitempty"`
+		DryRun bool      `json:"dryRun,omitempty"`
+		Queued bool      `json:"queued,omitempty"`
+	}{
+		Resource: r.Resource,
+		Base:     r.Base,
+		Action:   r.Action,
+		DryRun:   r.DryRun,
+		Queued:   r.Queued,
+	}
+	if r.Error != nil {
+		out.Error = r.Error.Error()
+	}
+	return json.Marshal(out)
+}
+
+// Results are the outcomes of handling all pull request resources for a webhook.
+type Results []Result
+
+// Failed returns true if any pull request resource could not be handled.
+func (r Results) Failed() bool {
+	for _, result := range r {
+		if result.Action == ActionFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort orders the results by kind, namespace and name.
+func (r Results) Sort() {
+	sort.SliceStable(r, func(i, j int) bool {
+		return key(r[i].Resource) < key(r[j].Resource)
+	})
+}
+
+func key(r Resource) string {
+	return r.Kind + "/" + r.Namespace + "/" + r.Name
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
+	"k8s.io/client-go/dynamic"
+)
+
+// DefaultTombstoneTTL is how long deleted pull request resources are remembered for.
+const DefaultTombstoneTTL = 24 * time.Hour
+
+// Tombstones remembers the pull request resources that have been deleted, with the time the pull
+// request was updated in the event that deleted them, so that an older event that arrives late, e.g.
+// an opened after a closed, does not recreate them.
+var Tombstones TombstoneStore = NewMemoryTombstones(DefaultTombstoneTTL)
+
+// TombstoneStore records deleted pull request resources.
+type TombstoneStore interface {
+	// Add records that the resource was deleted by an event for the pull request updated at updated.
+	Add(ctx context.Context, r Resource, updated time.Time) error
+	// Get returns the time the pull request was updated in the event that deleted the resource.
+	Get(ctx context.Context, r Resource) (time.Time, bool, error)
+	// Remove forgets that the resource was deleted.
+	Remove(ctx context.Context, r Resource) error
+}
+
+// MemoryTombstones is a TombstoneStore of the resources deleted by this replica, which is lost when
+// it restarts.
+type MemoryTombstones struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	deleted map[string]tombstone
+}
+
+type tombstone struct {
+	updated time.Time
+	added   time.Time
+}
+
+// NewMemoryTombstones creates a TombstoneStore remembering deleted resources for the ttl.
+func NewMemoryTombstones(ttl time.Duration) *MemoryTombstones {
+	return &MemoryTombstones{ttl: ttl, deleted: make(map[string]tombstone)}
+}
+
+// Add records that the resource was deleted by an event for the pull request updated at updated.
+func (t *MemoryTombstones) Add(_ context.Context, r Resource, updated time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for k, d := range t.deleted {
+		if now.Sub(d.added) >= t.ttl {
+			delete(t.deleted, k)
+		}
+	}
+
+	if d, ok := t.deleted[key(r)]; ok && d.updated.After(updated) {
+		return nil
+	}
+	t.deleted[key(r)] = tombstone{updated: updated, added: now}
+	return nil
+}
+
+// Get returns the time the pull request was updated in the event that deleted the resource.
+func (t *MemoryTombstones) Get(_ context.Context, r Resource) (time.Time, bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	d, ok := t.deleted[key(r)]
+	if !ok || time.Since(d.added) >= t.ttl {
+		return time.Time{}, false, nil
+	}
+	return d.updated, true, nil
+}
+
+// Remove forgets that the resource was deleted.
+func (t *MemoryTombstones) Remove(_ context.Context, r Resource) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.deleted, key(r))
+	return nil
+}
+
+// ConfigMapTombstones is a TombstoneStore in a ConfigMap, keyed by resource with the time the pull
+// request was updated, so that tombstones survive restarts and are shared by every replica.
+type ConfigMapTombstones struct {
+	store *configmap.Store
+}
+
+// NewConfigMapTombstones creates a TombstoneStore remembering up to maxEntries deleted resources for
+// the ttl in the ConfigMap, which is created if it doesn't exist.
+func NewConfigMapTombstones(d dynamic.Interface, namespace string, name string, ttl time.Duration, maxEntries int) *ConfigMapTombstones {
+	return &ConfigMapTombstones{store: configmap.New(d, namespace, name, ttl, maxEntries)}
+}
+
+// Add records that the resource was deleted by an event for the pull request updated at updated.
+func (t *ConfigMapTombstones) Add(ctx context.Context, r Resource, updated time.Time) error {
+	k := configmap.Key(key(r))
+	return t.store.Update(ctx, func(entries map[string]configmap.Entry, now time.Time) bool {
+		if e, ok := entries[k]; ok && !parseUpdated(e).Before(updated) {
+			return false
+		}
+		entries[k] = configmap.Entry{Value: updated.UTC().Format(time.RFC3339Nano), Added: now}
+		return true
+	})
+}
+
+// Get returns the time the pull request was updated in the event that deleted the resource.
+func (t *ConfigMapTombstones) Get(ctx context.Context, r Resource) (time.Time, bool, error) {
+	e, ok, err := t.store.Get(ctx, configmap.Key(key(r)))
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	return parseUpdated(e), true, nil
+}
+
+// Remove forgets that the resource was deleted.
+func (t *ConfigMapTombstones) Remove(ctx context.Context, r Resource) error {
+	k := configmap.Key(key(r))
+	return t.store.Update(ctx, func(entries map[string]configmap.Entry, _ time.Time) bool {
+		if _, ok := entries[k]; !ok {
+			return false
+		}
+		delete(entries, k)
+		return true
+	})
+}
+
+// parseUpdated returns the time the pull request was updated stored in the entry, or the zero time if
+// it cannot be parsed.
+func parseUpdated(e configmap.Entry) time.Time {
+	updated, _ := time.Parse(time.RFC3339Nano, e.Value)
+	return updated
+}
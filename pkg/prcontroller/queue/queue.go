@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DefaultMaxRetries is the default number of times a failed event is retried, which with the default
+// delays retries a failed event for over 20 minutes before it is dropped.
+const DefaultMaxRetries = 12
+
+var (
+	// RetryDelay is how long to wait before retrying a failed event for the first time, the delay
+	// doubles with each retry.
+	RetryDelay = time.Second
+
+	// MaxRetryDelay is the longest to wait before retrying a failed event.
+	MaxRetryDelay = 5 * time.Minute
+)
+
+// Event is a verified pull request webhook waiting to be handled.
+type Event struct {
+	Driver   string
+	Delivery string
+	Hook     *scm.PullRequestHook
+
+	// Delete, if set, are the pull request resources of the pull request to delete instead of handling
+	// the hook, e.g. those of a closed pull request found by a resync.
+	Delete []Resource
+
+	// Release, if set, is called when the event is dropped after failing every retry, e.g. so that the
+	// delivery can be redelivered.
+	Release func()
+}
+
+// Resource is a pull request resource of a kind.
+type Resource struct {
+	Kind   defines.GroupVersionResourceKind
+	Object *unstructured.Unstructured
+}
+
+// Key identifies the pull request of the event, events with the same key are handled in order. The
+// canonical clone url already identifies the SCM, so events queued by a resync share the key of the
+// webhooks for the same pull request.
+func (e Event) Key() string {
+	return fmt.Sprintf("%s#%d", scmclient.Canonical(e.Hook.Repo.Clone), e.Hook.PullRequest.Number)
+}
+
+// HandleFunc handles an event, events that return an error are retried with backoff.
+type HandleFunc func(ctx context.Context, e Event) error
+
+// Handle handles an event with handler.Handle, or deletes its resources with handler.Delete, failing if
+// any pull request resource could not be created, updated or deleted.
+func Handle(ctx context.Context, e Event) error {
+	ctx, cancel := context.WithTimeout(ctx, handler.HandleTimeout)
+	defer cancel()
+
+	if len(e.Delete) > 0 {
+		var failed handler.Results
+		for _, r := range e.Delete {
+			if result := handler.Delete(ctx, handler.Dynamic, e.Hook, r.Kind, r.Object); result.Action == handler.ActionFailed {
+				failed = append(failed, result)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("unable to delete %d pull request resources: %v", len(failed), failed[0].Error)
+		}
+		return nil
+	}
+
+	statusCode, response := handler.Handle(ctx, e.Driver, e.Hook)
+	if statusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s: %s", response.Message, response.Error)
+	}
+	return nil
+}
+
+// Queue is a rate limited work queue of pull request events. The events of each pull request are
+// handled one at a time in the order they were received, failed events are retried with backoff and
+// block the later events of the same pull request until they succeed or are dropped.
+type Queue struct {
+	queue      workqueue.RateLimitingInterface
+	handle     HandleFunc
+	maxRetries int
+
+	lock    sync.Mutex
+	pending map[string][]Event
+}
+
+// New creates a new Queue handling events with handle, retrying failed events up to maxRetries times.
+func New(handle HandleFunc, maxRetries int) *Queue {
+	return &Queue{
+		// webhooks are not redelivered once accepted, so retries back off slowly enough to outlast
+		// transient API server and SCM failures
+		queue: workqueue.NewRateLimitingQueueWithConfig(workqueue.NewItemExponentialFailureRateLimiter(RetryDelay, MaxRetryDelay), workqueue.RateLimitingQueueConfig{
+			Name: "pull-requests",
+		}),
+		handle:     handle,
+		maxRetries: maxRetries,
+		pending:    make(map[string][]Event),
+	}
+}
+
+// Add queues the event.
+func (q *Queue) Add(e Event) {
+	key := e.Key()
+
+	q.lock.Lock()
+	q.pending[key] = append(q.pending[key], e)
+	q.lock.Unlock()
+
+	q.queue.Add(key)
+}
+
+// Len returns the number of events waiting to be handled.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := 0
+	for _, events := range q.pending {
+		n += len(events)
+	}
+	return n
+}
+
+// Start starts the workers, which stop when the context is done.
+func (q *Queue) Start(ctx context.Context, workers int) {
+	go func() {
+		<-ctx.Done()
+		q.queue.ShutDown()
+	}()
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, q.worker, time.Second)
+	}
+}
+
+func (q *Queue) worker(ctx context.Context) {
+	for q.processNext(ctx) {
+	}
+}
+
+// processNext handles the pending events of the next pull request, returning false when the queue
+// has been shut down.
+func (q *Queue) processNext(ctx context.Context) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	key, ok := item.(string)
+	if !ok {
+		q.queue.Forget(item)
+		return true
+	}
+
+	for {
+		e, ok := q.peek(key)
+		if !ok {
+			q.queue.Forget(key)
+			return true
+		}
+
+		if err := q.handle(ctx, e); err != nil {
+			if retries := q.queue.NumRequeues(key); retries < q.maxRetries {
+				logrus.Warnf("unable to handle %s for %s, retrying (%d/%d): %v", e.Hook.Action, key, retries+1, q.maxRetries, err)
+				q.queue.AddRateLimited(key)
+				return true
+			}
+			logrus.Errorf("unable to handle %s for %s, dropping it after %d retries: %v", e.Hook.Action, key, q.maxRetries, err)
+			if e.Release != nil {
+				e.Release()
+			}
+		}
+
+		q.pop(key)
+		q.queue.Forget(key)
+	}
+}
+
+// peek returns the oldest pending event of the pull request.
+func (q *Queue) peek(key string) (Event, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	events := q.pending[key]
+	if len(events) == 0 {
+		delete(q.pending, key)
+		return Event{}, false
+	}
+	return events[0], true
+}
+
+// pop removes the oldest pending event of the pull request.
+func (q *Queue) pop(key string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if events := q.pending[key]; len(events) > 1 {
+		q.pending[key] = events[1:]
+	} else {
+		delete(q.pending, key)
+	}
+}
@@ -0,0 +1,195 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/queue"
+	"github.com/jenkins-x/go-scm/scm"
+)
+
+// recorder records the events it handles, failing each event the number of times configured.
+type recorder struct {
+	lock     sync.Mutex
+	failures map[string]int
+	handled  []string
+}
+
+func (r *recorder) handle(_ context.Context, e queue.Event) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	id := e.Delivery
+	if r.failures[id] > 0 {
+		r.failures[id]--
+		r.handled = append(r.handled, id+" failed")
+		return errors.New("failed")
+	}
+	r.handled = append(r.handled, id)
+	return nil
+}
+
+func (r *recorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		handled := append([]string(nil), r.handled...)
+		r.lock.Unlock()
+		if len(handled) >= n {
+			return handled
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d events", n)
+	return nil
+}
+
+// fastRetries shortens the delays before retrying failed events for the test.
+func fastRetries(t *testing.T) {
+	delay, maxDelay := queue.RetryDelay, queue.MaxRetryDelay
+	queue.RetryDelay, queue.MaxRetryDelay = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { queue.RetryDelay, queue.MaxRetryDelay = delay, maxDelay })
+}
+
+func TestQueue(t *testing.T) {
+	fastRetries(t)
+
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   map[string]int
+		events     []queue.Event
+		want       []string
+	}{
+		{
+			name:       "in order",
+			maxRetries: queue.DefaultMaxRetries,
+			events:     []queue.Event{event("1", 416, scm.ActionOpen), event("2", 416, scm.ActionSync), event("3", 416, scm.ActionClose)},
+			want:       []string{"1", "2", "3"},
+		},
+		{
+			name:       "retried",
+			maxRetries: queue.DefaultMaxRetries,
+			failures:   map[string]int{"1": 2},
+			events:     []queue.Event{event("1", 416, scm.ActionOpen), event("2", 416, scm.ActionClose)},
+			want:       []string{"1 failed", "1 failed", "1", "2"},
+		},
+		{
+			name:       "dropped",
+			maxRetries: 1,
+			failures:   map[string]int{"1": 5},
+			events:     []queue.Event{event("1", 416, scm.ActionOpen), event("2", 416, scm.ActionClose)},
+			want:       []string{"1 failed", "1 failed", "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{failures: tt.failures}
+			q := queue.New(r.handle, tt.maxRetries)
+			for _, e := range tt.events {
+				q.Add(e)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q.Start(ctx, 2)
+
+			if got := r.wait(t, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("handled %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueReleasesDropped(t *testing.T) {
+	fastRetries(t)
+
+	r := &recorder{failures: map[string]int{"1": 5, "2": 1}}
+	q := queue.New(r.handle, 1)
+
+	var lock sync.Mutex
+	var released []string
+	for _, e := range []queue.Event{event("1", 416, scm.ActionOpen), event("2", 416, scm.ActionClose)} {
+		id := e.Delivery
+		e.Release = func() {
+			lock.Lock()
+			defer lock.Unlock()
+			released = append(released, id)
+		}
+		q.Add(e)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx, 2)
+
+	r.wait(t, 4)
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"1"}; !reflect.DeepEqual(released, want) {
+		t.Errorf("released %v, want %v", released, want)
+	}
+}
+
+func TestQueueBacksOff(t *testing.T) {
+	r := &recorder{failures: map[string]int{"1": 1}}
+	q := queue.New(r.handle, queue.DefaultMaxRetries)
+	q.Add(event("1", 416, scm.ActionOpen))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx, 1)
+
+	// the event is not retried before the first retry delay
+	r.wait(t, 1)
+	time.Sleep(queue.RetryDelay / 2)
+	if got := r.wait(t, 1); len(got) != 1 {
+		t.Errorf("handled %v before the retry delay, want only the first failure", got)
+	}
+	if got, want := r.wait(t, 2), []string{"1 failed", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+}
+
+func TestQueueKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		a    queue.Event
+		b    queue.Event
+		same bool
+	}{
+		{name: "same pull request", a: event("1", 416, scm.ActionOpen), b: event("2", 416, scm.ActionClose), same: true},
+		{name: "different pull request", a: event("1", 416, scm.ActionOpen), b: event("2", 417, scm.ActionOpen)},
+		{name: "different driver name", a: event("1", 416, scm.ActionOpen), b: withDriver(event("", 416, scm.ActionUpdate), "github-enterprise"), same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := tt.a.Key() == tt.b.Key(); same != tt.same {
+				t.Errorf("keys %s and %s, want same %v", tt.a.Key(), tt.b.Key(), tt.same)
+			}
+		})
+	}
+}
+
+func event(delivery string, number int, action scm.Action) queue.Event {
+	return queue.Event{
+		Driver:   "github",
+		Delivery: delivery,
+		Hook: &scm.PullRequestHook{
+			Action:      action,
+			Repo:        scm.Repository{Clone: "https://github.com/jenkins-x/go-scm.git"},
+			PullRequest: scm.PullRequest{Number: number},
+		},
+	}
+}
+
+func withDriver(e queue.Event, driver string) queue.Event {
+	e.Driver = driver
+	return e
+}
@@ -0,0 +1,55 @@
+package replay
+
+import (
+	"context"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
+	"k8s.io/client-go/dynamic"
+)
+
+// DefaultConfigMapMaxEntries is the default number of deliveries remembered in a ConfigMap, lower than
+// DefaultMaxEntries as the whole ConfigMap is read and written for every delivery.
+const DefaultConfigMapMaxEntries = configmap.DefaultMaxEntries
+
+// ConfigMap is a Store of deliveries in a ConfigMap, keyed by Key with the time each was received, so
+// that the window survives restarts and is shared by every replica.
+type ConfigMap struct {
+	store *configmap.Store
+}
+
+// NewConfigMap creates a Store remembering up to maxEntries deliveries for the ttl in the ConfigMap,
+// which is created if it doesn't exist.
+func NewConfigMap(d dynamic.Interface, namespace string, name string, ttl time.Duration, maxEntries int) *ConfigMap {
+	return &ConfigMap{store: configmap.New(d, namespace, name, ttl, maxEntries)}
+}
+
+// Reserve records the delivery, returning false if it has already been received.
+func (c *ConfigMap) Reserve(ctx context.Context, key string) (bool, error) {
+	key = configmap.Key(key)
+
+	reserved := true
+	err := c.store.Update(ctx, func(entries map[string]configmap.Entry, now time.Time) bool {
+		if _, ok := entries[key]; ok {
+			reserved = false
+			return false
+		}
+		reserved = true
+		entries[key] = configmap.Entry{Added: now}
+		return true
+	})
+	return reserved, err
+}
+
+// Release forgets the delivery.
+func (c *ConfigMap) Release(ctx context.Context, key string) error {
+	key = configmap.Key(key)
+
+	return c.store.Update(ctx, func(entries map[string]configmap.Entry, _ time.Time) bool {
+		if _, ok := entries[key]; !ok {
+			return false
+		}
+		delete(entries, key)
+		return true
+	})
+}
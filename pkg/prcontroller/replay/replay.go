@@ -0,0 +1,89 @@
+package replay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
+)
+
+// DefaultMaxEntries is the default number of deliveries remembered.
+const DefaultMaxEntries = 10000
+
+// deliveryHeaders are the headers containing the unique id of a delivery for each driver.
+var deliveryHeaders = map[string]string{
+	"github":    "X-GitHub-Delivery",
+	"gitlab":    "X-Gitlab-Event-UUID",
+	"gitea":     "X-Gitea-Delivery",
+	"gogs":      "X-Gogs-Delivery",
+	"bitbucket": "X-Request-UUID",
+	"stash":     "X-Request-Id",
+}
+
+// DeliveryID returns the unique id of a webhook delivery, or an empty string if the driver doesn't
+// send one. The id is not covered by the signature of the delivery, so it only identifies the delivery
+// in logs, see Key.
+func DeliveryID(driver string, req *http.Request) string {
+	header, ok := deliveryHeaders[driver]
+	if !ok {
+		return ""
+	}
+	return req.Header.Get(header)
+}
+
+// Key returns the key a delivery is remembered by, a digest of its verified body. A captured delivery
+// could be replayed with a new delivery id, which is not signed, but not with a different body.
+func Key(driver string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return driver + "/" + hex.EncodeToString(sum[:])
+}
+
+// Store remembers the deliveries received within a window, keyed by Key, so that replayed deliveries
+// can be rejected.
+type Store interface {
+	// Reserve records the delivery, returning false if it has already been received.
+	Reserve(ctx context.Context, key string) (bool, error)
+	// Release forgets the delivery, so that it can be redelivered after it failed.
+	Release(ctx context.Context, key string) error
+}
+
+// Memory is a Store of the deliveries received by this replica.
+type Memory struct {
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewMemory creates a Store remembering up to maxEntries deliveries for the ttl.
+func NewMemory(ttl time.Duration, maxEntries int) *Memory {
+	return &Memory{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]time.Time)}
+}
+
+// Reserve records the delivery, returning false if it has already been received.
+func (m *Memory) Reserve(_ context.Context, key string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	if received, ok := m.entries[key]; ok && now.Sub(received) < m.ttl {
+		return false, nil
+	}
+	m.entries[key] = now
+	configmap.Prune(m.entries, now, m.ttl, m.maxEntries)
+	return true, nil
+}
+
+// Release forgets the delivery.
+func (m *Memory) Release(_ context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
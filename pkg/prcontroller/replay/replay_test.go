@@ -0,0 +1,134 @@
+package replay_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/configmap"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/replay"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(ttl time.Duration, maxEntries int) replay.Store
+	}{
+		{
+			name: "memory",
+			store: func(ttl time.Duration, maxEntries int) replay.Store {
+				return replay.NewMemory(ttl, maxEntries)
+			},
+		},
+		{
+			name: "configmap",
+			store: func(ttl time.Duration, maxEntries int) replay.Store {
+				d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+					map[schema.GroupVersionResource]string{configmap.GVR: "ConfigMapList"})
+				return replay.NewConfigMap(d, "pr-controller", "deliveries", ttl, maxEntries)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			t.Run("duplicates", func(t *testing.T) {
+				s := tt.store(time.Hour, 10)
+				assertReserve(t, s, "github/1", true)
+				assertReserve(t, s, "github/1", false)
+				assertReserve(t, s, "gitlab/1", true)
+			})
+
+			t.Run("release", func(t *testing.T) {
+				s := tt.store(time.Hour, 10)
+				assertReserve(t, s, "github/1", true)
+				if err := s.Release(ctx, "github/1"); err != nil {
+					t.Fatal(err)
+				}
+				assertReserve(t, s, "github/1", true)
+			})
+
+			t.Run("expiry", func(t *testing.T) {
+				s := tt.store(time.Second, 10)
+				assertReserve(t, s, "github/1", true)
+				time.Sleep(1100 * time.Millisecond)
+				assertReserve(t, s, "github/1", true)
+			})
+
+			t.Run("bounded", func(t *testing.T) {
+				s := tt.store(time.Hour, 2)
+				assertReserve(t, s, "github/1", true)
+				time.Sleep(1100 * time.Millisecond)
+				assertReserve(t, s, "github/2", true)
+				assertReserve(t, s, "github/3", true)
+				// the oldest delivery has been forgotten
+				assertReserve(t, s, "github/1", true)
+				assertReserve(t, s, "github/3", false)
+			})
+		})
+	}
+}
+
+func TestConfigMapIsShared(t *testing.T) {
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{configmap.GVR: "ConfigMapList"})
+
+	first := replay.NewConfigMap(d, "pr-controller", "deliveries", time.Hour, 10)
+	second := replay.NewConfigMap(d, "pr-controller", "deliveries", time.Hour, 10)
+
+	assertReserve(t, first, "github/1", true)
+	assertReserve(t, second, "github/1", false)
+}
+
+func TestDeliveryID(t *testing.T) {
+	tests := []struct {
+		driver string
+		header string
+		want   string
+	}{
+		{driver: "github", header: "X-GitHub-Delivery", want: "1234"},
+		{driver: "gitlab", header: "X-Gitlab-Event-UUID", want: "1234"},
+		{driver: "gitea", header: "X-Gitea-Delivery", want: "1234"},
+		{driver: "stash", header: "X-Request-Id", want: "1234"},
+		{driver: "azure", header: "X-Request-Id", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/"+tt.driver, nil)
+			req.Header.Add(tt.header, "1234")
+			if got := replay.DeliveryID(tt.driver, req); got != tt.want {
+				t.Errorf("DeliveryID(%s) = %q, want %q", tt.driver, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	if replay.Key("github", body) != replay.Key("github", body) {
+		t.Error("Key() differs for the same body")
+	}
+	if replay.Key("github", body) == replay.Key("github", []byte(`{"action":"closed"}`)) {
+		t.Error("Key() is the same for different bodies")
+	}
+	if replay.Key("github", body) == replay.Key("gitlab", body) {
+		t.Error("Key() is the same for different drivers")
+	}
+}
+
+func assertReserve(t *testing.T, s replay.Store, id string, want bool) {
+	t.Helper()
+
+	got, err := s.Reserve(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Reserve(%s) = %v, want %v", id, got, want)
+	}
+}
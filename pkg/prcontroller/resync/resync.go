@@ -0,0 +1,378 @@
+package resync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/queue"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// Resyncer periodically reconciles pull request resources against the SCM, so that missed webhooks
+// do not leave resources behind. Resources whose pull requests have been closed or merged, or now
+// target a different branch to their base resource, are deleted, and resources for open pull requests
+// that are missing or have a stale commit are created or updated.
+type Resyncer struct {
+	cache    *cache.Cache
+	dynamic  dynamic.Interface
+	queue    *queue.Queue
+	interval time.Duration
+	dryRun   bool
+}
+
+// New creates a new Resyncer, if dryRun is true the actions that would be taken are only logged. Pull
+// requests are handled, and the resources of closed or retargeted pull requests deleted, through the
+// queue, so they are serialised with their webhooks, or directly if it is nil.
+func New(c *cache.Cache, d dynamic.Interface, q *queue.Queue, interval time.Duration, dryRun bool) *Resyncer {
+	return &Resyncer{
+		cache:    c,
+		dynamic:  d,
+		queue:    q,
+		interval: interval,
+		dryRun:   dryRun,
+	}
+}
+
+// Start resyncs every interval until the context is cancelled.
+func (r *Resyncer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// a resync must finish before the next one starts
+				resyncCtx, cancel := context.WithTimeout(ctx, r.interval)
+				results := r.Resync(resyncCtx)
+				cancel()
+				logrus.Infof("resync complete, %d pull request resources reconciled", len(results))
+			}
+		}
+	}()
+}
+
+// Resync reconciles all pull request resources against the SCM once.
+func (r *Resyncer) Resync(ctx context.Context) handler.Results {
+	mappings := r.cache.Mappings()
+	pairs := handler.Pairs(r.cache.Kinds(), mappings)
+
+	s := &scms{clients: make(map[string]*scmClient), pullRequests: make(map[string]*scm.PullRequest)}
+
+	var results handler.Results
+	results = append(results, r.collect(ctx, pairs, s)...)
+	results = append(results, r.reconcile(ctx, pairs, mappings, s)...)
+	results.Sort()
+
+	for _, result := range results {
+		logrus.Infof("resync: %s (dry-run: %t, queued: %t)", result, result.DryRun, result.Queued)
+	}
+	return results
+}
+
+// collect deletes the pull request resources whose pull requests have been closed or merged, or have
+// been retargeted. Only GitHub reports the previous target of a retargeted pull request in its webhooks,
+// so this is how the resources for the previous target are removed for the other drivers.
+func (r *Resyncer) collect(ctx context.Context, pairs []handler.Pair, s *scms) handler.Results {
+	var results handler.Results
+
+	seen := make(map[defines.GroupVersionResourceKind]bool)
+	for _, p := range pairs {
+		v := p.PullRequest
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+
+		objs, err := r.cache.List(ctx, v)
+		if err != nil {
+			logrus.Errorf("resync: unable to list %s: %v", v.Kind, err)
+			continue
+		}
+
+		for _, obj := range objs {
+			if !defines.IsManaged(obj) {
+				continue
+			}
+
+			number, ok := defines.PullRequestNumberOf(obj)
+			gitURL := r.cache.Options(v).Source().Read(obj).URL
+			if !ok || gitURL == "" {
+				continue
+			}
+
+			pr, err := s.pullRequest(ctx, gitURL, number)
+			if err != nil {
+				logrus.Debugf("resync: unable to find PR-%d for %s/%s: %v", number, obj.GetNamespace(), obj.GetName(), err)
+				continue
+			}
+			if !pr.Closed && !pr.Merged && !r.retargeted(ctx, pairs, v, obj, pr) {
+				continue
+			}
+
+			results = append(results, r.delete(ctx, s, gitURL, pr, v, obj))
+		}
+	}
+
+	return results
+}
+
+// retargeted returns true if the pull request targets a different branch to the base resource the pull
+// request resource was created from.
+func (r *Resyncer) retargeted(ctx context.Context, pairs []handler.Pair, v defines.GroupVersionResourceKind, obj *unstructured.Unstructured, pr *scm.PullRequest) bool {
+	name := obj.GetAnnotations()[defines.BaseNameAnnotation]
+	kind := obj.GetAnnotations()[defines.BaseKindAnnotation]
+	if name == "" || kind == "" {
+		return false
+	}
+
+	for _, p := range pairs {
+		if p.PullRequest != v || p.Base.Kind != kind {
+			continue
+		}
+		base, exists, err := r.cache.Get(ctx, p.Base, obj.GetNamespace(), name)
+		if err != nil || !exists {
+			return false
+		}
+		return r.cache.Options(p.Base).Source().Read(base).Branch != pr.Target
+	}
+	return false
+}
+
+// delete deletes the pull request resource through the queue, so that it is serialised with the
+// webhooks for the pull request, or directly if it is nil.
+func (r *Resyncer) delete(ctx context.Context, s *scms, gitURL string, pr *scm.PullRequest, gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) handler.Result {
+	result := handler.Result{
+		Resource: handler.Resource{Kind: gvrk.Kind, Namespace: obj.GetNamespace(), Name: obj.GetName()},
+		Action:   handler.ActionDeleted,
+		DryRun:   r.dryRun,
+	}
+	if r.dryRun {
+		return result
+	}
+
+	action := scm.ActionUpdate
+	if pr.Closed || pr.Merged {
+		action = scm.ActionClose
+	}
+	_, repo, _ := s.client(gitURL)
+	hook := &scm.PullRequestHook{
+		Action:      action,
+		Repo:        scm.Repository{FullName: repo, Clone: gitURL},
+		PullRequest: *pr,
+	}
+
+	if r.queue != nil {
+		r.queue.Add(queue.Event{Driver: s.driver(gitURL), Hook: hook, Delete: []queue.Resource{{Kind: gvrk, Object: obj}}})
+		result.Queued = true
+		return result
+	}
+
+	return handler.Delete(ctx, r.dynamic, hook, gvrk, obj)
+}
+
+// reconcile creates or updates the pull request resources for open pull requests that are missing
+// or have a stale commit.
+func (r *Resyncer) reconcile(ctx context.Context, pairs []handler.Pair, mappings []defines.Mapping, s *scms) handler.Results {
+	var results handler.Results
+
+	// the base resources for each git url
+	bases := make(map[string][]base)
+	for _, p := range pairs {
+		objs, err := r.cache.List(ctx, p.Base)
+		if err != nil {
+			logrus.Errorf("resync: unable to list %s: %v", p.Base.Kind, err)
+			continue
+		}
+		for _, obj := range objs {
+			if !p.Applies(mappings, obj.GetNamespace()) {
+				continue
+			}
+			gitURL := r.cache.Options(p.Base).Source().Read(obj).URL
+			if gitURL != "" {
+				bases[gitURL] = append(bases[gitURL], base{gvrk: p.Base, pr: p.PullRequest, obj: obj})
+			}
+		}
+	}
+
+	for gitURL, resources := range bases {
+		prs, repo, err := s.openPullRequests(ctx, gitURL)
+		if err != nil {
+			logrus.Debugf("resync: unable to list open pull requests for %s: %v", gitURL, err)
+			continue
+		}
+
+		for _, pr := range prs {
+			if pr.Draft {
+				continue
+			}
+
+			hook := &scm.PullRequestHook{
+				Action:      scm.ActionUpdate,
+				Repo:        scm.Repository{FullName: repo, Clone: gitURL},
+				PullRequest: *pr,
+			}
+			stale := r.stale(ctx, resources, hook)
+			if len(stale) == 0 {
+				continue
+			}
+
+			if r.dryRun {
+				results = append(results, stale...)
+				continue
+			}
+
+			if r.queue != nil {
+				r.queue.Add(queue.Event{Driver: s.driver(gitURL), Hook: hook})
+				for i := range stale {
+					stale[i].Queued = true
+				}
+				results = append(results, stale...)
+				continue
+			}
+
+			_, response := handler.Handle(ctx, s.driver(gitURL), hook)
+			results = append(results, response.Resources...)
+		}
+	}
+
+	return results
+}
+
+// stale returns the pull request resources for the pull request that are missing or have a stale
+// commit, and those that exist for base resources built from paths the pull request doesn't change.
+func (r *Resyncer) stale(ctx context.Context, resources []base, hook *scm.PullRequestHook) handler.Results {
+	pr := &hook.PullRequest
+	files := handler.NewChangedFiles(hook)
+
+	var results handler.Results
+	for _, b := range resources {
+		source := r.cache.Options(b.gvrk).Source().Read(b.obj)
+		if source.Branch != pr.Target {
+			continue
+		}
+
+		name := defines.PullRequestName(b.obj.GetName(), pr.Number)
+		result := handler.Result{
+			Resource: handler.Resource{Kind: b.pr.Kind, Namespace: b.obj.GetNamespace(), Name: name},
+			Base:     &handler.Resource{Kind: b.gvrk.Kind, Namespace: b.obj.GetNamespace(), Name: b.obj.GetName()},
+			DryRun:   r.dryRun,
+		}
+
+		existing, exists, err := r.cache.Get(ctx, b.pr, b.obj.GetNamespace(), name)
+		if err != nil {
+			logrus.Errorf("resync: unable to get %s %s/%s: %v", b.pr.Kind, b.obj.GetNamespace(), name, err)
+			continue
+		}
+		// base resources built from paths the pull request doesn't change have no pull request resource
+		if !files.Changed(ctx, defines.Paths(b.obj, source)) {
+			if exists && defines.IsManaged(existing) {
+				result.Action = handler.ActionDeleted
+				results = append(results, result)
+			}
+			continue
+		}
+
+		if !exists {
+			result.Action = handler.ActionCreated
+			results = append(results, result)
+			continue
+		}
+
+		if r.cache.Options(b.pr).Source().Read(existing).Commit != pr.Sha {
+			result.Action = handler.ActionUpdated
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+type base struct {
+	gvrk defines.GroupVersionResourceKind
+	pr   defines.GroupVersionResourceKind
+	obj  *unstructured.Unstructured
+}
+
+// scms caches the SCM clients and pull requests looked up during a resync.
+type scms struct {
+	clients      map[string]*scmClient
+	pullRequests map[string]*scm.PullRequest
+}
+
+type scmClient struct {
+	client *scm.Client
+	repo   string
+	err    error
+}
+
+func (s *scms) client(gitURL string) (*scm.Client, string, error) {
+	c, ok := s.clients[gitURL]
+	if !ok {
+		c = &scmClient{}
+		c.client, c.repo, c.err = scmclient.ForURL(gitURL)
+		s.clients[gitURL] = c
+	}
+	return c.client, c.repo, c.err
+}
+
+func (s *scms) driver(gitURL string) string {
+	c, _, err := s.client(gitURL)
+	if err != nil {
+		return ""
+	}
+	return c.Driver.String()
+}
+
+func (s *scms) pullRequest(ctx context.Context, gitURL string, number int) (*scm.PullRequest, error) {
+	c, repo, err := s.client(gitURL)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%s#%d", repo, number)
+	if pr, ok := s.pullRequests[key]; ok {
+		return pr, nil
+	}
+
+	pr, _, err := c.PullRequests.Find(ctx, repo, number)
+	if err != nil {
+		return nil, err
+	}
+	s.pullRequests[key] = pr
+	return pr, nil
+}
+
+func (s *scms) openPullRequests(ctx context.Context, gitURL string) ([]*scm.PullRequest, string, error) {
+	c, repo, err := s.client(gitURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var prs []*scm.PullRequest
+	opts := &scm.PullRequestListOptions{Page: 1, Size: 100, Open: true}
+	for {
+		page, res, err := c.PullRequests.List(ctx, repo, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, pr := range page {
+			if !pr.Closed && !pr.Merged {
+				prs = append(prs, pr)
+			}
+		}
+		if res == nil || res.Page.Next == 0 {
+			return prs, repo, nil
+		}
+		opts.Page = res.Page.Next
+	}
+}
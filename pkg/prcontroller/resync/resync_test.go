@@ -0,0 +1,293 @@
+package resync_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/internal/applytest"
+	"github.com/garethjevans/pr-controller/pkg/internal/fixtures"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/queue"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/resync"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	exampleGVR            = schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "examples"}
+	examplePullRequestGVR = schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "examplepullrequests"}
+)
+
+// fakeGitHub serves two open pull requests, #2 and #3, and a closed pull request, #1. Pull request #2
+// changes src/main.go and #3 changes README.md. Pull request #4 has been retargeted to release.
+func fakeGitHub(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/repos/jenkins-x/go-scm/pulls":
+			_, _ = w.Write([]byte(`[
+				{"number": 2, "state": "open", "head": {"ref": "feature-2", "sha": "222"}, "base": {"ref": "main"}},
+				{"number": 3, "state": "open", "head": {"ref": "feature-3", "sha": "333"}, "base": {"ref": "main"}},
+				{"number": 4, "state": "open", "head": {"ref": "feature-4", "sha": "444"}, "base": {"ref": "release"}},
+				{"number": 5, "state": "open", "draft": true, "head": {"ref": "feature-5", "sha": "555"}, "base": {"ref": "main"}}
+			]`))
+		case "/api/v3/repos/jenkins-x/go-scm/pulls/1":
+			_, _ = w.Write([]byte(`{"number": 1, "state": "closed", "merged": true, "updated_at": "2024-01-02T03:04:05Z", "head": {"ref": "feature-1", "sha": "111"}, "base": {"ref": "main"}}`))
+		case "/api/v3/repos/jenkins-x/go-scm/pulls/2":
+			_, _ = w.Write([]byte(`{"number": 2, "state": "open", "head": {"ref": "feature-2", "sha": "222"}, "base": {"ref": "main"}}`))
+		case "/api/v3/repos/jenkins-x/go-scm/pulls/4":
+			_, _ = w.Write([]byte(`{"number": 4, "state": "open", "head": {"ref": "feature-4", "sha": "444"}, "base": {"ref": "release"}}`))
+		case "/api/v3/repos/jenkins-x/go-scm/pulls/2/files":
+			_, _ = w.Write([]byte(`[{"filename": "src/main.go"}]`))
+		case "/api/v3/repos/jenkins-x/go-scm/pulls/3/files":
+			_, _ = w.Write([]byte(`[{"filename": "README.md"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func resource(kind string, name string, gitURL string, branch string, commit string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1alpha1",
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "my-namespace",
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{
+				"git": map[string]interface{}{
+					"url":    gitURL,
+					"branch": branch,
+					"commit": commit,
+				},
+			},
+		},
+	}}
+	if kind == "ExamplePullRequest" {
+		u.SetLabels(map[string]string{defines.ManagedByLabel: defines.ManagedBy})
+	}
+	return u
+}
+
+func setup(t *testing.T, gitURL string, paths string) dynamic.Interface {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	base := resource("Example", "go-scm", gitURL, "main", "")
+	// created for the main branch before the pull request was retargeted
+	retargeted := resource("ExamplePullRequest", "go-scm-pr-4", gitURL, "feature-4", "444")
+	retargeted.SetAnnotations(map[string]string{defines.BaseNameAnnotation: "go-scm", defines.BaseKindAnnotation: "Example"})
+	if paths != "" {
+		base.SetAnnotations(map[string]string{defines.PathsAnnotation: paths})
+	}
+
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+				{Name: "examplepullrequests", SingularName: "examplepullrequest", Namespaced: true, Kind: "ExamplePullRequest"},
+			},
+		},
+	}
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR:  "SupplyChainList",
+			exampleGVR:            "ExampleList",
+			examplePullRequestGVR: "ExamplePullRequestList",
+		},
+		fixtures.SupplyChain("examples", "Example"),
+		fixtures.SupplyChain("example-prs", "ExamplePullRequest"),
+		base,
+		resource("ExamplePullRequest", "go-scm-pr-1", gitURL, "feature-1", "111"),
+		resource("ExamplePullRequest", "go-scm-pr-2", gitURL, "feature-2", "old"),
+		retargeted,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	applytest.AddReactor(d)
+	handler.Dynamic = d
+	handler.Discovery = fakeDiscovery
+	handler.Mapper = defines.NewMapper(fakeDiscovery)
+	handler.Cache = cache.New(d, handler.Mapper, time.Minute)
+	if err := handler.Cache.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestResync(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      bool
+		paths       string
+		want        []string
+		wantExists  map[string]bool
+		wantCommits map[string]string
+	}{
+		{
+			name: "reconciles pull request resources",
+			want: []string{
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-1",
+				"updated ExamplePullRequest my-namespace/go-scm-pr-2",
+				"created ExamplePullRequest my-namespace/go-scm-pr-3",
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-4",
+			},
+			wantExists:  map[string]bool{"go-scm-pr-1": false, "go-scm-pr-2": true, "go-scm-pr-3": true, "go-scm-pr-4": false, "go-scm-pr-5": false},
+			wantCommits: map[string]string{"go-scm-pr-2": "222", "go-scm-pr-3": "333"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			want: []string{
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-1",
+				"updated ExamplePullRequest my-namespace/go-scm-pr-2",
+				"created ExamplePullRequest my-namespace/go-scm-pr-3",
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-4",
+			},
+			wantExists:  map[string]bool{"go-scm-pr-1": true, "go-scm-pr-2": true, "go-scm-pr-3": false, "go-scm-pr-4": true},
+			wantCommits: map[string]string{"go-scm-pr-2": "old"},
+		},
+		{
+			name:  "skips paths not changed",
+			paths: "src/**",
+			want: []string{
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-1",
+				"updated ExamplePullRequest my-namespace/go-scm-pr-2",
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-4",
+			},
+			wantExists:  map[string]bool{"go-scm-pr-2": true, "go-scm-pr-3": false},
+			wantCommits: map[string]string{"go-scm-pr-2": "222"},
+		},
+		{
+			name:  "deletes paths no longer changed",
+			paths: "docs/**",
+			want: []string{
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-1",
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-2",
+				"deleted ExamplePullRequest my-namespace/go-scm-pr-4",
+			},
+			wantExists: map[string]bool{"go-scm-pr-2": false, "go-scm-pr-3": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := fakeGitHub(t)
+			u, _ := url.Parse(s.URL)
+
+			scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+			t.Setenv("GITHUB_TOKEN", "token")
+
+			gitURL := s.URL + "/jenkins-x/go-scm"
+			d := setup(t, gitURL, tt.paths)
+
+			results := resync.New(handler.Cache, d, nil, time.Minute, tt.dryRun).Resync(context.Background())
+
+			if len(results) != len(tt.want) {
+				t.Fatalf("Resync() = %v, want %v", results, tt.want)
+			}
+			for i, result := range results {
+				if result.String() != tt.want[i] || result.DryRun != tt.dryRun {
+					t.Errorf("Resync()[%d] = %s (dry-run %t), want %s", i, result, result.DryRun, tt.want[i])
+				}
+			}
+
+			for name, exists := range tt.wantExists {
+				got, err := d.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), name, v1.GetOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					t.Fatal(err)
+				}
+				if (err == nil) != exists {
+					t.Errorf("expected %s exists to be %t", name, exists)
+				}
+				if commit, ok := tt.wantCommits[name]; ok && got != nil {
+					if c, _, _ := unstructured.NestedString(got.Object, "spec", "source", "git", "commit"); c != commit {
+						t.Errorf("expected %s to have commit %s, got %s", name, commit, c)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestResyncQueued(t *testing.T) {
+	s := fakeGitHub(t)
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	gitURL := s.URL + "/jenkins-x/go-scm"
+	d := setup(t, gitURL, "")
+
+	handled := make(chan error, 10)
+	q := queue.New(func(ctx context.Context, e queue.Event) error {
+		err := queue.Handle(ctx, e)
+		handled <- err
+		return err
+	}, 0)
+
+	results := resync.New(handler.Cache, d, q, time.Minute, false).Resync(context.Background())
+	for _, result := range results {
+		if !result.Queued {
+			t.Errorf("%s queued = false, want true", result)
+		}
+	}
+	// deletes are queued too, so that they are serialised with the webhooks for the pull request
+	if q.Len() != 4 {
+		t.Fatalf("queued %d events, want an event for each of PR-1, PR-2, PR-3 and PR-4", q.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx, 1)
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-handled:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the queued events")
+		}
+	}
+
+	for _, name := range []string{"go-scm-pr-1", "go-scm-pr-4"} {
+		if _, err := d.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), name, v1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected %s to be deleted by the queue: %v", name, err)
+		}
+	}
+	// the resource of the merged pull request is remembered, so that a late event doesn't recreate it
+	if _, ok, err := handler.Tombstones.Get(context.Background(), handler.Resource{Kind: "ExamplePullRequest", Namespace: "my-namespace", Name: "go-scm-pr-1"}); err != nil || !ok {
+		t.Errorf("expected a tombstone for go-scm-pr-1: %v", err)
+	}
+	if _, err := d.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-3", v1.GetOptions{}); err != nil {
+		t.Errorf("expected go-scm-pr-3 to be created by the queue: %v", err)
+	}
+}
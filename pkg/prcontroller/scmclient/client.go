@@ -0,0 +1,59 @@
+package scmclient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+)
+
+// ErrNoToken is returned when no token has been configured for a driver.
+var ErrNoToken = errors.New("no token configured")
+
+// Identifier maps git hosts to go-scm drivers, additional hosts can be mapped with $GIT_DRIVERS,
+// e.g. GIT_DRIVERS=github.example.com=github.
+var Identifier = factory.DefaultIdentifier
+
+// TokenEnvVar is the environment variable containing the API token for a driver.
+func TokenEnvVar(driver string) string {
+	return strings.ToUpper(driver) + "_TOKEN"
+}
+
+// ServerURLEnvVar is the environment variable that overrides the server url for a driver.
+func ServerURLEnvVar(driver string) string {
+	return strings.ToUpper(driver) + "_SERVER_URL"
+}
+
+// ForURL creates a client for the SCM hosting the git url, returning the client and the full name
+// of the repository.
+func ForURL(gitURL string) (*scm.Client, string, error) {
+	u, err := ParseURL(gitURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	driver, err := identify(u.Host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := os.Getenv(TokenEnvVar(driver))
+	if token == "" {
+		return nil, "", fmt.Errorf("%w for %s, set %s", ErrNoToken, driver, TokenEnvVar(driver))
+	}
+
+	serverURL := os.Getenv(ServerURLEnvVar(driver))
+	if serverURL == "" && u.Host != "github.com" && u.Host != "gitlab.com" {
+		serverURL = u.ServerURL()
+	}
+
+	client, err := factory.NewClient(driver, serverURL, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client, u.Path, nil
+}
@@ -0,0 +1,131 @@
+package scmclient
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// GitURL is a git url parsed from any of the forms git accepts, e.g.
+// https://user@github.com/org/repo.git, ssh://git@github.com/org/repo or git@github.com:org/repo.git.
+type GitURL struct {
+	// Scheme is the scheme of the web and API server, ssh urls are assumed to be served over https.
+	Scheme string
+	// Host is the lower case host of the server, including the port for http(s) urls.
+	Host string
+	// Path is the full path of the repository without .git, including any GitLab subgroups, e.g.
+	// group/subgroup/repo, but not the /scm prefix of Bitbucket Server http(s) urls.
+	Path string
+}
+
+// ParseURL parses a git url, stripping any credentials.
+func ParseURL(raw string) (GitURL, error) {
+	raw = strings.TrimSpace(raw)
+
+	// scp-like ssh urls, e.g. git@github.com:org/repo.git
+	if !strings.Contains(raw, "://") {
+		i := strings.Index(raw, ":")
+		if i < 0 || strings.Contains(raw[:i], "/") {
+			return GitURL{}, fmt.Errorf("invalid git url %s", raw)
+		}
+		host := raw[:i]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		return GitURL{Scheme: "https", Host: strings.ToLower(host), Path: cleanPath(raw[i+1:])}, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return GitURL{}, err
+	}
+	if u.Hostname() == "" {
+		return GitURL{}, fmt.Errorf("invalid git url %s", raw)
+	}
+
+	g := GitURL{Scheme: "https", Host: strings.ToLower(u.Hostname()), Path: cleanPath(u.Path)}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		g.Scheme = strings.ToLower(u.Scheme)
+		g.Host = strings.ToLower(u.Host)
+		// Bitbucket Server serves http(s) clones under /scm, e.g. /scm/proj/repo.git, but not ssh clones.
+		// Other SCMs can have a group named scm, so the host must be mapped to stash with $GIT_DRIVERS.
+		if parts := strings.Split(g.Path, "/"); len(parts) == 3 && parts[0] == "scm" && isStash(g.Host) {
+			g.Path = strings.Join(parts[1:], "/")
+		}
+	case "ssh", "git", "git+ssh", "ssh+git":
+		// the port of an ssh url is not the port of the server
+	default:
+		return GitURL{}, fmt.Errorf("unsupported scheme %s in git url %s", u.Scheme, raw)
+	}
+	return g, nil
+}
+
+// isStash returns true if the host is a Bitbucket Server.
+func isStash(host string) bool {
+	driver, err := identify(host)
+	return err == nil && (driver == "stash" || driver == "bitbucketserver")
+}
+
+// identify returns the driver of the host, falling back to the host without its port so that
+// servers on a non-default port match the hosts mapped with $GIT_DRIVERS.
+func identify(host string) (string, error) {
+	driver, err := Identifier.Identify(host)
+	if err != nil {
+		if name := hostname(host); name != host {
+			return Identifier.Identify(name)
+		}
+	}
+	return driver, err
+}
+
+// hostname returns the host without its port.
+func hostname(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		return host[:i]
+	}
+	return host
+}
+
+// Canonical returns the canonical form of the url, host/path, so that the different forms of the
+// url of a repository can be compared.
+func (g GitURL) Canonical() string {
+	return hostname(g.Host) + "/" + g.Path
+}
+
+// FullName returns the full name of the repository as webhooks report it, which is the path except
+// for Azure DevOps, whose urls are org/project/_git/repo and full names project/repo.
+func (g GitURL) FullName() string {
+	parts := strings.Split(g.Path, "/")
+	for i := 1; i < len(parts)-1; i++ {
+		if parts[i] == "_git" {
+			return parts[i-1] + "/" + strings.Join(parts[i+1:], "/")
+		}
+	}
+	return g.Path
+}
+
+// ServerURL returns the url of the web and API server hosting the repository.
+func (g GitURL) ServerURL() string {
+	return g.Scheme + "://" + g.Host
+}
+
+// Canonical returns the canonical form of a git url, see GitURL.Canonical. Urls that cannot be
+// parsed are returned trimmed and in lower case.
+func Canonical(raw string) string {
+	g, err := ParseURL(raw)
+	if err != nil {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(raw), "/"), ".git"))
+	}
+	return g.Canonical()
+}
+
+func cleanPath(p string) string {
+	// GitLab web urls, e.g. group/repo/-/tree/main
+	if i := strings.Index(p, "/-/"); i >= 0 {
+		p = p[:i]
+	}
+	p = strings.Trim(p, "/")
+	p = strings.TrimSuffix(p, ".git")
+	return strings.Trim(p, "/")
+}
@@ -0,0 +1,163 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// Key is the key in a Secret containing the shared secrets.
+const Key = "shared-secret"
+
+// RepositoryIndex is the name of the index of Secrets by the lower case repository annotation.
+const RepositoryIndex = "repository"
+
+// namespaceFile contains the namespace of the pod when running in a cluster.
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// SecretGVR is the resource for Secrets.
+var SecretGVR = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// Store is an informer backed cache of the Secrets in the controller namespace that contain the
+// shared secrets of a repository. Secrets are selected by the pr-controller/repo label and matched by
+// the full name of the repository in the pr-controller/repo annotation, e.g. org/name, ignoring case.
+// If the Secret also has a pr-controller/driver label it is only used for that driver.
+type Store struct {
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer k8scache.SharedIndexInformer
+
+	start    sync.Once
+	startErr error
+}
+
+// New creates a new Store of the Secrets in the namespace.
+func New(d dynamic.Interface, namespace string, resync time.Duration) *Store {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(d, resync, namespace, func(options *metav1.ListOptions) {
+		options.LabelSelector = defines.RepositoryLabel
+	})
+	return &Store{factory: factory, informer: factory.ForResource(SecretGVR).Informer()}
+}
+
+// syncTimeout is how long to wait for the initial list of Secrets.
+const syncTimeout = time.Minute
+
+// Start starts watching Secrets, if they are not already being watched, and waits for the initial
+// list of them to be loaded. The Secrets are watched until the context of the first call is done, if
+// the initial list can't be loaded in time Start can be called again to keep waiting for it.
+func (s *Store) Start(ctx context.Context) error {
+	s.start.Do(func() {
+		s.startErr = s.watch(ctx)
+	})
+	if s.startErr != nil {
+		return s.startErr
+	}
+
+	syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	if !k8scache.WaitForCacheSync(syncCtx.Done(), s.informer.HasSynced) {
+		return fmt.Errorf("unable to sync secrets")
+	}
+	return nil
+}
+
+// watch indexes the Secrets by repository and starts watching them.
+func (s *Store) watch(ctx context.Context) error {
+	err := s.informer.AddIndexers(k8scache.Indexers{RepositoryIndex: func(obj interface{}) ([]string, error) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, nil
+		}
+		repo := u.GetAnnotations()[defines.RepositoryAnnotation]
+		if repo == "" {
+			logrus.Warnf("ignoring secret %s, it has no %s annotation", u.GetName(), defines.RepositoryAnnotation)
+			return nil, nil
+		}
+		return []string{strings.ToLower(repo)}, nil
+	}})
+	if err != nil {
+		return err
+	}
+
+	s.factory.Start(ctx.Done())
+	return nil
+}
+
+// Lookup returns the name of the Secret and the shared secrets for the repository, or no secrets if
+// there is no Secret for it. If more than one Secret matches their secrets are combined.
+func (s *Store) Lookup(driver string, repo string) (string, []string) {
+	objs, err := s.informer.GetIndexer().ByIndex(RepositoryIndex, strings.ToLower(repo))
+	if err != nil {
+		logrus.Errorf("unable to lookup the secrets for %s: %v", repo, err)
+		return "", nil
+	}
+
+	secrets := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok || !strings.EqualFold(u.GetAnnotations()[defines.RepositoryAnnotation], repo) {
+			continue
+		}
+		if d, ok := u.GetLabels()[defines.DriverLabel]; ok && d != defines.LabelValue(driver) {
+			continue
+		}
+		secrets = append(secrets, u)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].GetName() < secrets[j].GetName()
+	})
+
+	var names []string
+	var values []string
+	for _, u := range secrets {
+		encoded, _, _ := unstructured.NestedString(u.Object, "data", Key)
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			logrus.Errorf("unable to decode %s in secret %s: %v", Key, u.GetName(), err)
+			continue
+		}
+		if v := Split(string(decoded)); len(v) > 0 {
+			names = append(names, u.GetName())
+			values = append(values, v...)
+		}
+	}
+	return strings.Join(names, ","), values
+}
+
+// Split splits shared secrets separated by newlines, ignoring blank lines and the whitespace around
+// each secret.
+func Split(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Namespace returns the namespace the controller is running in, from $POD_NAMESPACE or the service
+// account, or an empty string if it is not known.
+func Namespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if b, err := os.ReadFile(namespaceFile); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	return ""
+}
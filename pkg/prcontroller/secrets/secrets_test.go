@@ -0,0 +1,101 @@
+package secrets_test
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/secrets"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestLookup(t *testing.T) {
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{secrets.SecretGVR: "SecretList"},
+		secret("pr-controller", "go-scm", map[string]string{defines.RepositoryLabel: ""}, "Jenkins-X/Go-SCM", "new-secret\nold-secret\n"),
+		secret("pr-controller", "go-scm-gitlab", map[string]string{defines.RepositoryLabel: "", defines.DriverLabel: "gitlab"}, "jenkins-x/go-scm", "gitlab-secret"),
+		secret("pr-controller", "other", map[string]string{defines.RepositoryLabel: ""}, "jenkins-x/other", "other-secret"),
+		secret("pr-controller", "dashed", map[string]string{defines.RepositoryLabel: ""}, "jenkins-x-go/scm", "dashed-secret"),
+		secret("pr-controller", "unlabelled", map[string]string{}, "jenkins-x/go-scm", "unlabelled-secret"),
+		secret("pr-controller", "unannotated", map[string]string{defines.RepositoryLabel: "jenkins-x-go-scm"}, "", "unannotated-secret"),
+		secret("other-namespace", "go-scm", map[string]string{defines.RepositoryLabel: ""}, "jenkins-x/go-scm", "other-namespace-secret"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := secrets.New(d, "pr-controller", time.Minute)
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		driver     string
+		repo       string
+		wantName   string
+		wantValues []string
+	}{
+		{name: "github", driver: "github", repo: "jenkins-x/go-scm", wantName: "go-scm", wantValues: []string{"new-secret", "old-secret"}},
+		{name: "gitlab", driver: "gitlab", repo: "jenkins-x/go-scm", wantName: "go-scm,go-scm-gitlab", wantValues: []string{"new-secret", "old-secret", "gitlab-secret"}},
+		{name: "other repository", driver: "github", repo: "jenkins-x/other", wantName: "other", wantValues: []string{"other-secret"}},
+		{name: "different case", driver: "github", repo: "JENKINS-X/GO-SCM", wantName: "go-scm", wantValues: []string{"new-secret", "old-secret"}},
+		{name: "same label value", driver: "github", repo: "jenkins-x-go/scm", wantName: "dashed", wantValues: []string{"dashed-secret"}},
+		{name: "unknown repository", driver: "github", repo: "jenkins-x/unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, values := store.Lookup(tt.driver, tt.repo)
+			if name != tt.wantName || !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("Lookup(%s, %s) = %s %v, want %s %v", tt.driver, tt.repo, name, values, tt.wantName, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{name: "empty", in: ""},
+		{name: "single", in: "secret\n", want: []string{"secret"}},
+		{name: "newlines", in: "new-secret\nold-secret\n", want: []string{"new-secret", "old-secret"}},
+		{name: "commas", in: "new-secret, old-secret", want: []string{"new-secret, old-secret"}},
+		{name: "carriage returns", in: "new-secret\r\nold-secret\r\n", want: []string{"new-secret", "old-secret"}},
+		{name: "blank lines", in: "\nnew-secret\n\n old-secret \n", want: []string{"new-secret", "old-secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := secrets.Split(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func secret(namespace string, name string, labels map[string]string, repo string, value string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"data": map[string]interface{}{
+			secrets.Key: base64.StdEncoding.EncodeToString([]byte(value)),
+		},
+	}}
+	u.SetLabels(labels)
+	if repo != "" {
+		u.SetAnnotations(map[string]string{defines.RepositoryAnnotation: repo})
+	}
+	return u
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces secrets in logs.
+const redacted = "REDACTED"
+
+// sensitiveHeaders are the headers that contain secrets, or signatures derived from them.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"X-Gitlab-Token",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Gitea-Signature",
+	"X-Gogs-Signature",
+}
+
+// secret is the list of shared secrets webhooks are verified with, one per line, so that webhooks
+// signed with either the old or new secret are accepted while a secret is rotated. It is read from the
+// file if one is configured, which is re-read whenever it changes so that a rotated secret is used
+// without a restart, otherwise from the list environment variable if it is set, otherwise from the
+// environment variable, which is a single secret used verbatim.
+type secret struct {
+	envVar     string
+	listEnvVar string
+	file       string
+
+	mu      sync.Mutex
+	loaded  bool
+	modTime time.Time
+	size    int64
+	values  []string
+}
+
+// Values returns the current secrets, no secrets disables verification.
+func (s *secret) Values() ([]string, error) {
+	if s.file == "" {
+		if v := os.Getenv(s.listEnvVar); v != "" {
+			return secrets.Split(v), nil
+		}
+		if v := os.Getenv(s.envVar); v != "" {
+			return []string{v}, nil
+		}
+		return nil, nil
+	}
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loaded && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.values, nil
+	}
+
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret file: %w", err)
+	}
+
+	if s.loaded {
+		logrus.Infof("reloaded secret from %s", s.file)
+	}
+	s.loaded, s.modTime, s.size = true, info.ModTime(), info.Size()
+	s.values = secrets.Split(string(b))
+
+	return s.values, nil
+}
+
+// String describes where the secret is read from, without revealing it.
+func (s *secret) String() string {
+	if s.file != "" {
+		return "file " + s.file
+	}
+	if os.Getenv(s.listEnvVar) != "" {
+		return s.listEnvVar
+	}
+	if os.Getenv(s.envVar) == "" {
+		return s.envVar + " (not set)"
+	}
+	return s.envVar
+}
+
+// requestFields returns the fields to log a request with, with any secrets redacted.
+func requestFields(req *http.Request) logrus.Fields {
+	headers := req.Header.Clone()
+	for _, h := range sensitiveHeaders {
+		if headers.Get(h) != "" {
+			headers.Set(h, redacted)
+		}
+	}
+
+	// bitbucket and gitea can send the secret as a query parameter
+	query := req.URL.Query()
+	if query.Get("secret") != "" {
+		query.Set("secret", redacted)
+	}
+
+	return logrus.Fields{
+		"method":  req.Method,
+		"path":    req.URL.Path,
+		"query":   query.Encode(),
+		"headers": headers,
+		"remote":  req.RemoteAddr,
+	}
+}
@@ -1,60 +1,142 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/queue"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/replay"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/secrets"
 	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/driver/azure"
 	"github.com/jenkins-x/go-scm/scm/factory"
 	"github.com/sirupsen/logrus"
 )
 
+// maxBodySize is the largest webhook that will be read, the same limit the drivers use.
+const maxBodySize = 10000000
+
+// secretMatches counts the webhooks verified with each secret, keyed by
+// <driver>/<where the secrets are from>/<index of the secret>, and is published at /debug/vars on
+// the metrics port.
+var secretMatches = expvar.NewMap("webhook_secret_matches")
+
+var (
+	// repositorySecrets are the Secrets containing the shared secrets of individual repositories, if
+	// nil every webhook is verified with the shared secrets of its driver.
+	repositorySecrets atomic.Pointer[secrets.Store]
+	// requireRepositorySecrets rejects webhooks until the repository secrets have been set.
+	requireRepositorySecrets atomic.Bool
+)
+
+// RequireRepositorySecrets rejects every webhook as unavailable until SetRepositorySecrets is called,
+// so that webhooks for a repository with secrets of its own are not verified with the shared secrets
+// of the driver while the Secrets are loaded.
+func RequireRepositorySecrets(require bool) {
+	requireRepositorySecrets.Store(require)
+}
+
+// SetRepositorySecrets sets the Secrets containing the shared secrets of individual repositories, it
+// is safe to call while webhooks are being handled.
+func SetRepositorySecrets(store *secrets.Store) {
+	repositorySecrets.Store(store)
+}
+
+// Deliveries are the recently received deliveries, pull request webhooks with a body that has already
+// been received are rejected. If nil, or the deliveries can't be read, every webhook is
+// handled.
+var Deliveries replay.Store
+
+// Queue is the queue pull request webhooks are handled from, if nil they are handled before the
+// response is written.
+var Queue *queue.Queue
+
+// Drivers are the drivers webhooks can be received from, each is served at /<driver>.
+var Drivers = []string{"github", "gitlab", "gitea", "gogs", "bitbucket", "stash", "azure"}
+
 type webhook struct {
 	driver string
 	wh     scm.WebhookService
+	secret *secret
 }
 
 type WebHook interface {
 	Handle(w http.ResponseWriter, req *http.Request)
 }
 
-func NewWebHook(driver string) (WebHook, error) {
-	wh, err := factory.NewWebHookService(driver)
+// NewWebHook creates the webhook handler for a driver, verifying webhooks with the secrets in the
+// secret file if one is given, otherwise with the secrets in $<DRIVER>_SHARED_SECRETS, one per line, or
+// the single secret in $<DRIVER>_SHARED_SECRET.
+func NewWebHook(driver string, secretFile string) (WebHook, error) {
+	wh, err := newWebHookService(driver)
 	if err != nil {
 		return nil, err
 	}
 
 	w := &webhook{wh: wh, driver: driver}
+	w.secret = &secret{envVar: w.EnvVar(), listEnvVar: w.EnvVar() + "S", file: secretFile}
 
-	logrus.Infof("Starting Handler for %s", driver)
-	logrus.Infof("%s secret is: %s", w.EnvVar(), os.Getenv(w.EnvVar()))
+	logrus.Infof("Starting Handler for %s, verifying webhooks with the secrets from %s", driver, w.secret)
+	if secrets, err := w.secret.Values(); err != nil {
+		logrus.Warnf("unable to read the %s secrets, webhooks will be rejected until they can be read: %v", driver, err)
+	} else if len(secrets) > 1 {
+		logrus.Infof("accepting %s webhooks verified with any of %d secrets", driver, len(secrets))
+	}
 
 	return w, nil
 }
 
+func newWebHookService(driver string) (scm.WebhookService, error) {
+	switch driver {
+	case "azure":
+		// the factory doesn't create azure webhook services, they don't need a server url to parse webhooks
+		return azure.NewDefault().Webhooks, nil
+	case "github", "gitlab", "gitea", "gogs", "bitbucket", "stash":
+		return factory.NewWebHookService(driver)
+	default:
+		return nil, fmt.Errorf("unsupported driver %s, expected one of %s", driver, strings.Join(Drivers, ", "))
+	}
+}
+
 func (w *webhook) EnvVar() string {
 	return strings.ToUpper(w.driver) + "_SHARED_SECRET"
 }
 
 func (w *webhook) Handle(wr http.ResponseWriter, req *http.Request) {
-	logrus.Debugf("handling request... %+v", req)
+	logrus.WithFields(requestFields(req)).Debugf("handling %s request...", w.driver)
 
-	hook, err := w.wh.Parse(req, func(webhook scm.Webhook) (string, error) {
-		return os.Getenv(w.EnvVar()), nil
-	})
+	store := repositorySecrets.Load()
+	if store == nil && requireRepositorySecrets.Load() {
+		handler.ResponseHTTPError(wr, http.StatusServiceUnavailable, "repository secrets have not been loaded")
+		return
+	}
+
+	hook, body, err := w.parse(req, store)
 	if err != nil {
 		handler.ResponseHTTPError(wr, 400, fmt.Sprintf("unable to parse webhook event: %v", err))
 		return
 	}
+	if hook == nil {
+		logrus.Infof("Unhandled %s webhook", w.driver)
+		handler.ResponseHTTPError(wr, 400, fmt.Sprintf("Unhandled %s webhook", w.driver))
+		return
+	}
 
 	switch hook.Kind() {
 	case scm.WebhookKindPullRequest:
 		prHook, ok := hook.(*scm.PullRequestHook)
 		if ok {
-			handler.PullRequest(prHook, wr)
+			w.pullRequest(wr, req, body, prHook)
 			return
 		}
 	default:
@@ -63,5 +145,208 @@ func (w *webhook) Handle(wr http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	handler.ResponseHTTP(wr, http.StatusAccepted, "Webhook Accepted")
+	handler.ResponseHTTP(wr, http.StatusAccepted, handler.Response{Message: "Webhook Accepted", Event: string(hook.Kind())})
+}
+
+// pullRequest handles a pull request webhook, rejecting deliveries whose verified body has already
+// been received.
+func (w *webhook) pullRequest(wr http.ResponseWriter, req *http.Request, body []byte, pr *scm.PullRequestHook) {
+	id := replay.DeliveryID(w.driver, req)
+
+	release := func() {}
+	if Deliveries != nil {
+		key := replay.Key(w.driver, body)
+		reserved, err := Deliveries.Reserve(req.Context(), key)
+		switch {
+		case err != nil:
+			logrus.Warnf("unable to check whether %s delivery %s is a replay, handling it: %v", w.driver, id, err)
+		case !reserved:
+			logrus.Warnf("rejecting %s delivery %s for PR-%d, it has already been received", w.driver, id, pr.PullRequest.Number)
+			handler.ResponseHTTP(wr, http.StatusConflict, handler.Response{
+				Message:    "Duplicate Delivery",
+				Event:      string(scm.WebhookKindPullRequest),
+				Action:     pr.Action.String(),
+				Repository: handler.Repository(pr),
+				Number:     pr.PullRequest.Number,
+				Error:      "the delivery has already been received",
+			})
+			return
+		default:
+			// allow a delivery that failed to be redelivered
+			release = func() {
+				if err := Deliveries.Release(context.Background(), key); err != nil {
+					logrus.Warnf("unable to release %s delivery %s: %v", w.driver, id, err)
+				}
+			}
+		}
+	}
+
+	// failures of queued events are retried by the queue, and released for redelivery once it gives up
+	if Queue != nil {
+		Queue.Add(queue.Event{Driver: w.driver, Delivery: id, Hook: pr, Release: release})
+		handler.ResponseHTTP(wr, http.StatusAccepted, handler.Response{
+			Message:    "PR Queued",
+			Event:      string(scm.WebhookKindPullRequest),
+			Action:     pr.Action.String(),
+			Repository: handler.Repository(pr),
+			Number:     pr.PullRequest.Number,
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handler.HandleTimeout)
+	defer cancel()
+
+	statusCode, response := handler.Handle(ctx, w.driver, pr)
+	if statusCode >= http.StatusInternalServerError {
+		release()
+	}
+	handler.ResponseHTTP(wr, statusCode, response)
+}
+
+// parse parses the webhook and verifies it with the secrets of its repository in the store, if any,
+// returning it with the verified body.
+func (w *webhook) parse(req *http.Request, store *secrets.Store) (scm.Webhook, []byte, error) {
+	// the body is consumed by each parse
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// parse without verifying to find the repository, which selects the secrets
+	hook, err := w.parseWith(req, body, "")
+	if err != nil || hook == nil {
+		return hook, nil, err
+	}
+
+	from, secrets, err := w.secretsFor(hook, store)
+	if err != nil {
+		logrus.Errorf("unable to verify %s webhook: %v", w.driver, err)
+		return nil, nil, scm.ErrSignatureInvalid
+	}
+
+	hook, err = w.verify(req, body, hook, from, secrets)
+	if err != nil || hook == nil {
+		return hook, nil, err
+	}
+
+	// the repository the secrets were selected for is not verified, so check the verified clone url,
+	// which the workloads are matched on, is for the same repository
+	if err := w.checkRepository(hook, from, store); err != nil {
+		logrus.Errorf("rejecting %s webhook: %v", w.driver, err)
+		return nil, nil, scm.ErrSignatureInvalid
+	}
+	return hook, body, nil
+}
+
+// verify verifies the webhook with the secrets, returning it parsed with the secret that matched.
+func (w *webhook) verify(req *http.Request, body []byte, hook scm.Webhook, from secretsSource, secrets []string) (scm.Webhook, error) {
+	if len(secrets) == 0 {
+		return hook, nil
+	}
+
+	// azure devops doesn't sign webhooks, the secret is sent as the password of the basic auth credentials
+	if w.driver == "azure" {
+		matched, ok := matchBasicAuth(req, secrets)
+		if !ok {
+			return nil, scm.ErrSignatureInvalid
+		}
+		w.verified(from.description, matched, len(secrets))
+		return hook, nil
+	}
+
+	// try each secret in turn, so that webhooks signed with either the old or new secret are accepted
+	// while a secret is rotated
+	for i, secret := range secrets {
+		hook, err := w.parseWith(req, body, secret)
+		if errors.Is(err, scm.ErrSignatureInvalid) {
+			continue
+		}
+		if err == nil {
+			w.verified(from.description, i, len(secrets))
+		}
+		return hook, err
+	}
+	return nil, scm.ErrSignatureInvalid
+}
+
+func (w *webhook) parseWith(req *http.Request, body []byte, secret string) (scm.Webhook, error) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return w.wh.Parse(req, func(webhook scm.Webhook) (string, error) {
+		return secret, nil
+	})
+}
+
+// secretsSource is where the secrets a webhook is verified with are from.
+type secretsSource struct {
+	// description describes where the secrets are from, without revealing them.
+	description string
+	// repository is the full name of the repository the secrets are for, empty for the secrets of the driver.
+	repository string
+}
+
+// secretsFor returns the secrets to verify the webhook with, those of the Secrets for its
+// repository if there are any, otherwise those of the driver, and where they are from.
+func (w *webhook) secretsFor(hook scm.Webhook, store *secrets.Store) (secretsSource, []string, error) {
+	if store != nil {
+		repo := handler.Repository(hook)
+		if name, values := store.Lookup(w.driver, repo); len(values) > 0 {
+			return secretsSource{description: "secret " + name, repository: repo}, values, nil
+		}
+	}
+	values, err := w.secret.Values()
+	return secretsSource{description: w.secret.String()}, values, err
+}
+
+// checkRepository checks that the clone url of a verified webhook is for the repository whose
+// secrets it was verified with, and that a webhook verified with the secrets of the driver is not
+// for a repository that has secrets of its own.
+func (w *webhook) checkRepository(hook scm.Webhook, from secretsSource, store *secrets.Store) error {
+	if from.repository == "" && store == nil {
+		return nil
+	}
+
+	clone := hook.Repository().Clone
+	u, err := scmclient.ParseURL(clone)
+	if err != nil {
+		if from.repository == "" {
+			return nil
+		}
+		return fmt.Errorf("unable to determine the repository of %s, verified with the secrets of %s: %w", clone, from.repository, err)
+	}
+
+	if from.repository != "" {
+		if !strings.EqualFold(u.FullName(), from.repository) {
+			return fmt.Errorf("%s is not the repository %s whose secrets it was verified with", clone, from.repository)
+		}
+		return nil
+	}
+	if _, values := store.Lookup(w.driver, u.FullName()); len(values) > 0 {
+		return fmt.Errorf("%s has its own secrets, but was verified with %s", clone, from.description)
+	}
+	return nil
+}
+
+// verified records which of the secrets a webhook was verified with, so that it is known when an
+// old secret is no longer used and can be removed.
+func (w *webhook) verified(source string, matched int, secrets int) {
+	secretMatches.Add(fmt.Sprintf("%s/%s/%d", w.driver, source, matched+1), 1)
+	if matched > 0 {
+		logrus.Infof("%s webhook verified with secret %d of %d from %s", w.driver, matched+1, secrets, source)
+	} else {
+		logrus.Debugf("%s webhook verified with secret %d of %d from %s", w.driver, matched+1, secrets, source)
+	}
+}
+
+func matchBasicAuth(req *http.Request, secrets []string) (int, bool) {
+	_, password, ok := req.BasicAuth()
+	if !ok {
+		return -1, false
+	}
+	for i, secret := range secrets {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1 {
+			return i, true
+		}
+	}
+	return -1, false
 }
@@ -1,18 +1,36 @@
 package server_test
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	discoveryfake "k8s.io/client-go/discovery/fake"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/internal/applytest"
+	"github.com/garethjevans/pr-controller/pkg/internal/fixtures"
 	"github.com/garethjevans/pr-controller/pkg/prcontroller/handler"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/queue"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/replay"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/secrets"
 	"github.com/garethjevans/pr-controller/pkg/prcontroller/server"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -35,7 +53,7 @@ func TestGitHubRequest(t *testing.T) {
 	req.Header.Add("X-GitHub-Event", "pull_request")
 	req.Header.Add("Content-Type", "application/json")
 
-	h, err := server.NewWebHook("github")
+	h, err := server.NewWebHook("github", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,7 +100,7 @@ func TestGitHubRequest(t *testing.T) {
 		Resource: "supplychains",
 	}
 
-	handler.Dynamic = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
 		map[schema.GroupVersionResource]string{
 			exampleGVR:                  "ExampleList",
 			examplePullRequestGVR:       "ExamplePullRequestList",
@@ -92,6 +110,8 @@ func TestGitHubRequest(t *testing.T) {
 			containerAppPullRequestGVR:  "ContainerAppWorkflowPRList",
 			supplyChainGvr:              "SupplyChainList",
 		},
+		fixtures.SupplyChain("examples", "Example"),
+		fixtures.SupplyChain("example-prs", "ExamplePullRequest"),
 		&unstructured.Unstructured{Object: map[string]interface{}{
 			"apiVersion": "example.com/v1alpha1",
 			"kind":       "Example",
@@ -108,7 +128,25 @@ func TestGitHubRequest(t *testing.T) {
 				},
 			},
 		}},
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1alpha1",
+			"kind":       "Example",
+			"metadata": map[string]interface{}{
+				"name":      "go-scm",
+				"namespace": "other-namespace",
+			},
+			"spec": map[string]interface{}{
+				"source": map[string]interface{}{
+					"git": map[string]interface{}{
+						"url":    "https://github.com/jenkins-x/go-scm",
+						"branch": "main",
+					},
+				},
+			},
+		}},
 	)
+	applytest.AddReactor(d)
+	handler.Dynamic = d
 
 	client := kubernetesfake.NewSimpleClientset()
 	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
@@ -164,10 +202,795 @@ func TestGitHubRequest(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+		t.Errorf("handler returned wrong content type: got %v", contentType)
+	}
 	// Check the response body is what we expect.
-	expected := `PR Accepted`
+	expected := `{"message":"PR Accepted","event":"pull_request","action":"opened","repository":"jenkins-x/go-scm","number":416,` +
+		`"matched":[{"kind":"Example","namespace":"my-namespace","name":"go-scm"},{"kind":"Example","namespace":"other-namespace","name":"go-scm"}],` +
+		`"resources":[` +
+		`{"kind":"ExamplePullRequest","namespace":"my-namespace","name":"go-scm-pr-416","base":{"kind":"Example","namespace":"my-namespace","name":"go-scm"},"action":"created"},` +
+		`{"kind":"ExamplePullRequest","namespace":"other-namespace","name":"go-scm-pr-416","base":{"kind":"Example","namespace":"other-namespace","name":"go-scm"},"action":"created"}]}`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got '%v' want '%v'",
 			strings.TrimSpace(rr.Body.String()), expected)
 	}
+
+	// Check the pull request resource records where it came from.
+	created, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := map[string]string{
+		defines.ManagedByLabel:  defines.ManagedBy,
+		defines.DriverLabel:     "github",
+		defines.RepositoryLabel: "jenkins-x-go-scm",
+		defines.NumberLabel:     "416",
+	}
+	if !reflect.DeepEqual(created.GetLabels(), wantLabels) {
+		t.Errorf("unexpected labels: got %v want %v", created.GetLabels(), wantLabels)
+	}
+	for _, annotation := range []string{defines.RepositoryAnnotation, defines.ShaAnnotation, defines.AuthorAnnotation, defines.BaseNameAnnotation, defines.BaseKindAnnotation} {
+		if created.GetAnnotations()[annotation] == "" {
+			t.Errorf("expected annotation %s to be set", annotation)
+		}
+	}
+}
+
+func TestDriverRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		driver     string
+		file       string
+		headers    map[string]string
+		gitURL     string
+		base       string
+		branch     string
+		number     int
+		wantAction string
+		want       string
+	}{
+		{
+			name:       "github synchronize",
+			driver:     "github",
+			file:       "testdata/github_pr_sync.json",
+			headers:    map[string]string{"X-GitHub-Event": "pull_request", "X-GitHub-Delivery": "123456"},
+			gitURL:     "https://github.com/bradrydzewski/drone-test-go",
+			base:       "drone-test-go",
+			branch:     "bradrydzewski-patch-1",
+			number:     1,
+			wantAction: "synchronized",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "github ready for review",
+			driver:     "github",
+			file:       "testdata/github_pr_ready_for_review.json",
+			headers:    map[string]string{"X-GitHub-Event": "pull_request", "X-GitHub-Delivery": "123456"},
+			gitURL:     "https://github.com/bradrydzewski/drone-test-go",
+			base:       "drone-test-go",
+			branch:     "bradrydzewski-patch-1",
+			number:     1,
+			wantAction: "ready_for_review",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "github labeled",
+			driver:     "github",
+			file:       "testdata/github_pr_labeled.json",
+			headers:    map[string]string{"X-GitHub-Event": "pull_request", "X-GitHub-Delivery": "123456"},
+			gitURL:     "https://github.com/bradrydzewski/drone-test-go",
+			base:       "drone-test-go",
+			branch:     "bradrydzewski-patch-1",
+			number:     1,
+			wantAction: "labeled",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "github edited",
+			driver:     "github",
+			file:       "testdata/github_pr_edited.json",
+			headers:    map[string]string{"X-GitHub-Event": "pull_request", "X-GitHub-Delivery": "123456"},
+			gitURL:     "https://github.com/bradrydzewski/drone-test-go",
+			base:       "drone-test-go",
+			branch:     "bradrydzewski-patch-1",
+			number:     1,
+			wantAction: "updated",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "github converted to draft",
+			driver:     "github",
+			file:       "testdata/github_pr_converted_to_draft.json",
+			headers:    map[string]string{"X-GitHub-Event": "pull_request", "X-GitHub-Delivery": "123456"},
+			gitURL:     "https://github.com/bradrydzewski/drone-test-go",
+			base:       "drone-test-go",
+			branch:     "bradrydzewski-patch-1",
+			number:     1,
+			wantAction: "converted_to_draft",
+			want:       handler.ActionDeleted,
+		},
+		{
+			name:       "gitlab updated",
+			driver:     "gitlab",
+			file:       "testdata/gitlab_pr_updated.json",
+			headers:    map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Event-UUID": "123456"},
+			gitURL:     "https://gitlab.com/gitlab-org/hello-world",
+			base:       "hello-world",
+			number:     1,
+			wantAction: "updated",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "bitbucket opened",
+			driver:     "bitbucket",
+			file:       "testdata/bitbucket_pr_opened.json",
+			headers:    map[string]string{"X-Event-Key": "pullrequest:created"},
+			gitURL:     "https://bitbucket.org/brydzewski/foo",
+			base:       "foo",
+			number:     1,
+			wantAction: "opened",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "bitbucket closed",
+			driver:     "bitbucket",
+			file:       "testdata/bitbucket_pr_closed.json",
+			headers:    map[string]string{"X-Event-Key": "pullrequest:rejected"},
+			gitURL:     "git@bitbucket.org:brydzewski/foo.git",
+			base:       "foo",
+			number:     2,
+			wantAction: "closed",
+			want:       handler.ActionDeleted,
+		},
+		{
+			name:       "bitbucket updated",
+			driver:     "bitbucket",
+			file:       "testdata/bitbucket_pr_updated.json",
+			headers:    map[string]string{"X-Event-Key": "pullrequest:updated"},
+			gitURL:     "https://bitbucket.org/brydzewski/foo",
+			base:       "foo",
+			number:     1,
+			wantAction: "synchronized",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "stash opened",
+			driver:     "stash",
+			file:       "testdata/stash_pr_opened.json",
+			headers:    map[string]string{"X-Event-Key": "pr:opened", "X-Request-Id": "123456"},
+			gitURL:     "https://bitbucket.example.com/scm/prj/my-repo.git",
+			base:       "my-repo",
+			number:     2,
+			wantAction: "opened",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "stash closed",
+			driver:     "stash",
+			file:       "testdata/stash_pr_closed.json",
+			headers:    map[string]string{"X-Event-Key": "pr:declined", "X-Request-Id": "123456"},
+			gitURL:     "https://bitbucket.example.com/scm/prj/my-repo.git",
+			base:       "my-repo",
+			number:     2,
+			wantAction: "closed",
+			want:       handler.ActionDeleted,
+		},
+		{
+			name:       "stash ref updated",
+			driver:     "stash",
+			file:       "testdata/stash_pr_ref_updated.json",
+			headers:    map[string]string{"X-Event-Key": "pr:from_ref_updated", "X-Request-Id": "123456"},
+			gitURL:     "https://bitbucket.example.com/scm/prj/my-repo.git",
+			base:       "my-repo",
+			number:     2,
+			wantAction: "synchronized",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "gitea opened",
+			driver:     "gitea",
+			file:       "testdata/gitea_pr_opened.json",
+			headers:    map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Delivery": "123456"},
+			gitURL:     "https://try.gitea.io/jcitizen/my-repo",
+			base:       "my-repo",
+			number:     1,
+			wantAction: "opened",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "gitea closed",
+			driver:     "gitea",
+			file:       "testdata/gitea_pr_closed.json",
+			headers:    map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Delivery": "123456"},
+			gitURL:     "https://try.gitea.io/jcitizen/my-repo",
+			base:       "my-repo",
+			number:     1,
+			wantAction: "closed",
+			want:       handler.ActionDeleted,
+		},
+		{
+			name:       "gitea synchronized",
+			driver:     "gitea",
+			file:       "testdata/gitea_pr_sync.json",
+			headers:    map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Delivery": "123456"},
+			gitURL:     "https://try.gitea.io/jcitizen/my-repo",
+			base:       "my-repo",
+			number:     1,
+			wantAction: "synchronized",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "gogs synchronized",
+			driver:     "gogs",
+			file:       "testdata/gogs_pr_sync.json",
+			headers:    map[string]string{"X-Gogs-Event": "pull_request", "X-Gogs-Delivery": "123456"},
+			gitURL:     "http://try.gogs.io/gogits/hello-world",
+			base:       "hello-world",
+			number:     2,
+			wantAction: "synchronized",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "azure created",
+			driver:     "azure",
+			file:       "testdata/azure_pr_created.json",
+			gitURL:     "https://dev.azure.com/fabrikam/DefaultCollection/_git/Fabrikam",
+			base:       "fabrikam",
+			number:     1,
+			wantAction: "created",
+			want:       handler.ActionCreated,
+		},
+		{
+			name:       "azure merged",
+			driver:     "azure",
+			file:       "testdata/azure_pr_merged.json",
+			gitURL:     "https://dev.azure.com/fabrikam/DefaultCollection/_git/Fabrikam",
+			base:       "fabrikam",
+			number:     1,
+			wantAction: "merged",
+			want:       handler.ActionDeleted,
+		},
+		{
+			name:       "azure abandoned",
+			driver:     "azure",
+			file:       "testdata/azure_pr_updated.json",
+			gitURL:     "https://dev.azure.com/fabrikam/DefaultCollection/_git/Fabrikam",
+			base:       "fabrikam",
+			number:     1,
+			wantAction: "updated",
+			want:       handler.ActionDeleted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			branch := tt.branch
+			if branch == "" {
+				branch = "master"
+			}
+			objects := []runtime.Object{
+				fixtures.SupplyChain("examples", "Example"),
+				fixtures.SupplyChain("example-prs", "ExamplePullRequest"),
+				fixtures.Example(tt.base, "my-namespace", tt.gitURL, branch),
+			}
+			if tt.want == handler.ActionDeleted {
+				objects = append(objects, &unstructured.Unstructured{Object: map[string]interface{}{
+					"apiVersion": "example.com/v1alpha1",
+					"kind":       "ExamplePullRequest",
+					"metadata": map[string]interface{}{
+						"name":      defines.PullRequestName(tt.base, tt.number),
+						"namespace": "my-namespace",
+						"labels":    map[string]interface{}{defines.ManagedByLabel: defines.ManagedBy},
+					},
+				}})
+			}
+			setupCluster(t, objects...)
+
+			h, err := server.NewWebHook(tt.driver, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/"+tt.driver, strings.NewReader(string(b)))
+			req.Header.Add("Content-Type", "application/json")
+			for k, v := range tt.headers {
+				req.Header.Add(k, v)
+			}
+
+			rr := httptest.NewRecorder()
+			h.Handle(rr, req)
+
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+			}
+
+			var response handler.Response
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Action != tt.wantAction || response.Number != tt.number {
+				t.Errorf("unexpected pull request: got %s PR-%d want %s PR-%d", response.Action, response.Number, tt.wantAction, tt.number)
+			}
+			if len(response.Resources) != 1 || response.Resources[0].Action != tt.want {
+				t.Fatalf("unexpected resources: got %+v want one %s", response.Resources, tt.want)
+			}
+			if name := response.Resources[0].Name; name != defines.PullRequestName(tt.base, tt.number) {
+				t.Errorf("unexpected resource name: got %s", name)
+			}
+		})
+	}
+}
+
+func TestDriverSecrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{name: "valid", password: "my-secret", want: http.StatusAccepted},
+		{name: "invalid", password: "not-my-secret", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AZURE_SHARED_SECRET", "my-secret")
+
+			b, err := os.ReadFile("testdata/azure_pr_created.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+			h, err := server.NewWebHook("azure", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/azure", strings.NewReader(string(b)))
+			req.SetBasicAuth("pr-controller", tt.password)
+
+			rr := httptest.NewRecorder()
+			h.Handle(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("handler returned wrong status code: got %v want %v: %s", rr.Code, tt.want, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestUnsupportedDriver(t *testing.T) {
+	if _, err := server.NewWebHook("fake", ""); err == nil {
+		t.Error("expected an error for an unsupported driver")
+	}
+}
+
+// setupCluster replaces the clients, cache and tombstones of the handler with fakes containing the
+// objects.
+func setupCluster(t *testing.T, objects ...runtime.Object) {
+	t.Helper()
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			{Group: "example.com", Version: "v1alpha1", Resource: "examples"}:                            "ExampleList",
+			{Group: "example.com", Version: "v1alpha1", Resource: "examplepullrequests"}:                 "ExamplePullRequestList",
+			{Group: "supply-chain.apps.tanzu.vmware.com", Version: "v1alpha1", Resource: "supplychains"}: "SupplyChainList",
+		},
+		objects...,
+	)
+	applytest.AddReactor(d)
+	handler.Dynamic = d
+
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Group: "example.com", Version: "v1alpha1", Kind: "Example"},
+				{Name: "examplepullrequests", SingularName: "examplepullrequest", Namespaced: true, Group: "example.com", Version: "v1alpha1", Kind: "ExamplePullRequest"},
+			},
+		},
+	}
+
+	handler.Discovery = fakeDiscovery
+	handler.Mapper = nil
+	handler.Cache = nil
+	handler.Tombstones = handler.NewMemoryTombstones(handler.DefaultTombstoneTTL)
+}
+
+func TestSecretFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "shared-secret")
+	if err := os.WriteFile(file, []byte("first-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/azure_pr_created.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+	h, err := server.NewWebHook("azure", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(password string) int {
+		req := httptest.NewRequest("POST", "/azure", strings.NewReader(string(b)))
+		req.SetBasicAuth("pr-controller", password)
+		rr := httptest.NewRecorder()
+		h.Handle(rr, req)
+		return rr.Code
+	}
+
+	if code := send("first-secret"); code != http.StatusAccepted {
+		t.Errorf("expected the secret in the file to be accepted: got %v", code)
+	}
+
+	// rotate the secret
+	if err := os.WriteFile(file, []byte("second-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := send("first-secret"); code != http.StatusBadRequest {
+		t.Errorf("expected the rotated secret to be rejected: got %v", code)
+	}
+	if code := send("second-secret"); code != http.StatusAccepted {
+		t.Errorf("expected the new secret to be accepted: got %v", code)
+	}
+
+	// webhooks are rejected if the secret can't be read
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if code := send("second-secret"); code != http.StatusBadRequest {
+		t.Errorf("expected webhooks to be rejected without a secret: got %v", code)
+	}
+}
+
+func TestSecretsAreNotLogged(t *testing.T) {
+	t.Setenv("GITLAB_SHARED_SECRET", "my-gitlab-secret")
+
+	logger := logrus.StandardLogger()
+	level := logger.GetLevel()
+	logger.SetLevel(logrus.DebugLevel)
+	defer logger.SetLevel(level)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	h, err := server.NewWebHook("gitlab", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/gitlab?secret=my-gitlab-secret", strings.NewReader("{}"))
+	req.Header.Add("X-Gitlab-Event", "Unknown Hook")
+	req.Header.Add("X-Gitlab-Token", "my-gitlab-secret")
+	h.Handle(httptest.NewRecorder(), req)
+
+	if len(hook.AllEntries()) == 0 {
+		t.Fatal("expected log entries")
+	}
+	for _, entry := range hook.AllEntries() {
+		line, err := entry.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "my-gitlab-secret") {
+			t.Errorf("secret was logged: %s", line)
+		}
+	}
+}
+
+func TestSecretIsVerbatim(t *testing.T) {
+	t.Setenv("GITHUB_SHARED_SECRET", " my secret, with commas ")
+
+	b, err := os.ReadFile("testdata/pr_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		want   int
+	}{
+		{name: "whole secret", secret: " my secret, with commas ", want: http.StatusAccepted},
+		{name: "part of the secret", secret: " my secret", want: http.StatusBadRequest},
+		{name: "trimmed secret", secret: "my secret, with commas", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+			h, err := server.NewWebHook("github", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			h.Handle(rr, signedGitHubRequest(b, tt.secret))
+
+			if rr.Code != tt.want {
+				t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, tt.want, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestMultipleSecrets(t *testing.T) {
+	t.Setenv("GITHUB_SHARED_SECRET", "unused-secret")
+	t.Setenv("GITHUB_SHARED_SECRETS", "new-secret\nold-secret\n")
+
+	b, err := os.ReadFile("testdata/pr_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		want      int
+		wantMatch string
+	}{
+		{name: "new secret", secret: "new-secret", want: http.StatusAccepted, wantMatch: "github/GITHUB_SHARED_SECRETS/1"},
+		{name: "old secret", secret: "old-secret", want: http.StatusAccepted, wantMatch: "github/GITHUB_SHARED_SECRETS/2"},
+		{name: "single secret", secret: "unused-secret", want: http.StatusBadRequest},
+		{name: "unknown secret", secret: "other-secret", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+			h, err := server.NewWebHook("github", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := signedGitHubRequest(b, tt.secret)
+
+			before := secretMatches(tt.wantMatch)
+			rr := httptest.NewRecorder()
+			h.Handle(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, tt.want, rr.Body.String())
+			}
+			if tt.wantMatch != "" && secretMatches(tt.wantMatch) != before+1 {
+				t.Errorf("expected the match to be counted against %s", tt.wantMatch)
+			}
+		})
+	}
+}
+
+func secretMatches(key string) int64 {
+	m, ok := expvar.Get("webhook_secret_matches").(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestRepositorySecrets(t *testing.T) {
+	t.Setenv("GITHUB_SHARED_SECRET", "global-secret")
+
+	b, err := os.ReadFile("testdata/pr_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fullName string
+		clone    string
+		secret   string
+		want     int
+	}{
+		{name: "repository secret", secret: "repository-secret", want: http.StatusAccepted},
+		{name: "global secret", secret: "global-secret", want: http.StatusBadRequest},
+		{name: "repository secret for another clone url", clone: "https://github.com/jenkins-x/other.git", secret: "repository-secret", want: http.StatusBadRequest},
+		{name: "global secret with another full name", fullName: "jenkins-x/other", secret: "global-secret", want: http.StatusBadRequest},
+		{name: "global secret for another repository", fullName: "jenkins-x/other", clone: "https://github.com/jenkins-x/other.git", secret: "global-secret", want: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			store := secrets.New(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{secrets.SecretGVR: "SecretList"},
+				&unstructured.Unstructured{Object: map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"metadata": map[string]interface{}{
+						"name":        "go-scm",
+						"namespace":   "pr-controller",
+						"labels":      map[string]interface{}{defines.RepositoryLabel: ""},
+						"annotations": map[string]interface{}{defines.RepositoryAnnotation: "Jenkins-X/go-scm"},
+					},
+					"data": map[string]interface{}{
+						secrets.Key: base64.StdEncoding.EncodeToString([]byte("repository-secret")),
+					},
+				}},
+			), "pr-controller", time.Minute)
+			if err := store.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			server.SetRepositorySecrets(store)
+			defer server.SetRepositorySecrets(nil)
+
+			h, err := server.NewWebHook("github", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := string(b)
+			if tt.fullName != "" {
+				body = strings.ReplaceAll(body, `"full_name": "jenkins-x/go-scm"`, `"full_name": "`+tt.fullName+`"`)
+			}
+			if tt.clone != "" {
+				body = strings.ReplaceAll(body, `"clone_url": "https://github.com/jenkins-x/go-scm.git"`, `"clone_url": "`+tt.clone+`"`)
+			}
+
+			rr := httptest.NewRecorder()
+			h.Handle(rr, signedGitHubRequest([]byte(body), tt.secret))
+
+			if rr.Code != tt.want {
+				t.Errorf("handler returned wrong status code: got %v want %v: %s", rr.Code, tt.want, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRepositorySecretsNotLoaded(t *testing.T) {
+	t.Setenv("GITHUB_SHARED_SECRET", "global-secret")
+
+	b, err := os.ReadFile("testdata/pr_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+	server.RequireRepositorySecrets(true)
+	defer server.RequireRepositorySecrets(false)
+
+	h, err := server.NewWebHook("github", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// webhooks are not verified with the global secret until the repository secrets are loaded
+	rr := httptest.NewRecorder()
+	h.Handle(rr, signedGitHubRequest(b, "global-secret"))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusServiceUnavailable, rr.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := secrets.New(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{secrets.SecretGVR: "SecretList"},
+	), "pr-controller", time.Minute)
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.SetRepositorySecrets(store)
+	defer server.SetRepositorySecrets(nil)
+
+	rr = httptest.NewRecorder()
+	h.Handle(rr, signedGitHubRequest(b, "global-secret"))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+}
+
+func signedGitHubRequest(body []byte, secret string) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	req := httptest.NewRequest("POST", "/github", strings.NewReader(string(body)))
+	req.Header.Add("X-GitHub-Delivery", "123456")
+	req.Header.Add("X-GitHub-Event", "pull_request")
+	req.Header.Add("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestReplayedDelivery(t *testing.T) {
+	b, err := os.ReadFile("testdata/pr_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupCluster(t, fixtures.SupplyChain("examples", "Example"), fixtures.SupplyChain("example-prs", "ExamplePullRequest"))
+
+	server.Deliveries = replay.NewMemory(time.Hour, replay.DefaultMaxEntries)
+	defer func() { server.Deliveries = nil }()
+
+	h, err := server.NewWebHook("github", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int{http.StatusAccepted, http.StatusConflict} {
+		rr := httptest.NewRecorder()
+		h.Handle(rr, signedGitHubRequest(b, ""))
+		if rr.Code != want {
+			t.Errorf("handler returned wrong status code: got %v want %v: %s", rr.Code, want, rr.Body.String())
+		}
+	}
+
+	// the delivery id is not signed, so a replay with a new one is still rejected
+	req := signedGitHubRequest(b, "")
+	req.Header.Set("X-GitHub-Delivery", "654321")
+	rr := httptest.NewRecorder()
+	h.Handle(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusConflict, rr.Body.String())
+	}
+}
+
+func TestQueuedRequest(t *testing.T) {
+	b, err := os.ReadFile("testdata/pr_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupCluster(t,
+		fixtures.SupplyChain("examples", "Example"),
+		fixtures.SupplyChain("example-prs", "ExamplePullRequest"),
+		fixtures.Example("go-scm", "my-namespace", "https://github.com/jenkins-x/go-scm", "main"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server.Queue = queue.New(queue.Handle, queue.DefaultMaxRetries)
+	server.Queue.Start(ctx, 1)
+	defer func() { server.Queue = nil }()
+
+	h, err := server.NewWebHook("github", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.Handle(rr, signedGitHubRequest(b, ""))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	expected := `{"message":"PR Queued","event":"pull_request","action":"opened","repository":"jenkins-x/go-scm","number":416}`
+	if strings.TrimSpace(rr.Body.String()) != expected {
+		t.Errorf("handler returned unexpected body: got '%v' want '%v'", strings.TrimSpace(rr.Body.String()), expected)
+	}
+
+	// the pull request resource is created by the queue
+	examplePullRequestGVR := schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "examplepullrequests"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := handler.Dynamic.Resource(examplePullRequestGVR).Namespace("my-namespace").Get(context.Background(), "go-scm-pr-416", v1.GetOptions{})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the pull request resource: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
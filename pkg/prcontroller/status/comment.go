@@ -0,0 +1,378 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// CommentMarker is a hidden marker used to find the summary comment on a pull request.
+const CommentMarker = "<!-- pr-controller:summary -->"
+
+// Commenter maintains a single summary comment on each pull request, listing the pull request
+// resources created for it. The comment is edited in place whenever one of them changes or is deleted.
+type Commenter struct {
+	cache *cache.Cache
+
+	lock sync.Mutex
+	// comments are the ids of the summary comments, keyed by repository and pull request number.
+	comments map[string]int
+	// bodies are the last bodies written to each summary comment, keyed by repository and pull request number.
+	bodies map[string]string
+	// locks serialise the updates of each summary comment, keyed by repository and pull request number.
+	locks map[string]*commentLock
+}
+
+// commentLock is held while a summary comment is updated, and counts the updates waiting for it.
+type commentLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewCommenter creates a new Commenter.
+func NewCommenter(c *cache.Cache) *Commenter {
+	return &Commenter{
+		cache:    c,
+		comments: make(map[string]int),
+		bodies:   make(map[string]string),
+		locks:    make(map[string]*commentLock),
+	}
+}
+
+// Start updates the summary comment whenever a pull request resource changes or is deleted, from
+// workers that stop when the context is done.
+func (c *Commenter) Start(ctx context.Context, workers int) {
+	q := newWorkQueue("comments", func(ctx context.Context, item interface{}) error {
+		key, ok := item.(pullRequestKey)
+		if !ok {
+			return nil
+		}
+		return c.update(ctx, key)
+	})
+
+	changed := func(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) {
+		if !isPullRequestKind(c.cache, gvrk) || !defines.IsManaged(obj) {
+			return
+		}
+		if key, ok := c.pullRequestOf(gvrk, obj); ok {
+			q.add(key)
+		}
+	}
+	c.cache.OnChange(changed)
+	c.cache.OnDelete(changed)
+	q.start(ctx, workers)
+}
+
+// pullRequestKey is a pull request whose summary comment is queued to be updated.
+type pullRequestKey struct {
+	gitURL string
+	branch string
+	number int
+}
+
+func (k pullRequestKey) String() string {
+	return fmt.Sprintf("%s#%d", k.gitURL, k.number)
+}
+
+// pullRequestOf returns the pull request a resource of the kind was created for.
+func (c *Commenter) pullRequestOf(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) (pullRequestKey, bool) {
+	source := c.cache.Options(gvrk).Source().Read(obj)
+	number, ok := defines.PullRequestNumberOf(obj)
+	if source.URL == "" || !ok {
+		return pullRequestKey{}, false
+	}
+	return pullRequestKey{gitURL: source.URL, branch: source.Branch, number: number}, true
+}
+
+// Comment creates or updates the summary comment on the pull request a resource of the kind was
+// created for, listing the resources that remain when it has been deleted.
+func (c *Commenter) Comment(ctx context.Context, gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) error {
+	if !defines.IsManaged(obj) {
+		return nil
+	}
+	key, ok := c.pullRequestOf(gvrk, obj)
+	if !ok {
+		return nil
+	}
+	return c.update(ctx, key)
+}
+
+// update creates or updates the summary comment on the pull request. Once the pull request has no
+// resources the comment is updated to say so, but not created, and is then forgotten.
+func (c *Commenter) update(ctx context.Context, pr pullRequestKey) error {
+	gitURL, number := pr.gitURL, pr.number
+
+	resources, err := c.resources(ctx, gitURL, pr.branch, number)
+	if err != nil {
+		return err
+	}
+
+	client, repo, err := scmclient.ForURL(gitURL)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s#%d", repo, number)
+	body := Summary(resources)
+
+	// serialise the updates of each comment, so concurrent changes don't create more than one, without
+	// waiting for the updates of other comments
+	unlock := c.lockComment(key)
+	defer unlock()
+
+	c.lock.Lock()
+	id, ok := c.comments[key]
+	unchanged := c.bodies[key] == body
+	c.lock.Unlock()
+
+	if unchanged {
+		return nil
+	}
+
+	if !ok {
+		id, err = findComment(ctx, client, repo, number)
+		if err != nil {
+			return err
+		}
+	}
+
+	input := &scm.CommentInput{Body: body}
+	if len(resources) == 0 {
+		if id != 0 {
+			logrus.Infof("updating summary comment %d on %s, it has no resources", id, key)
+			if _, err := editComment(ctx, client, repo, number, id, input); err != nil {
+				return err
+			}
+		}
+		c.lock.Lock()
+		delete(c.comments, key)
+		delete(c.bodies, key)
+		c.lock.Unlock()
+		return nil
+	}
+
+	if id != 0 {
+		logrus.Infof("updating summary comment %d on %s", id, key)
+		if id, err = editComment(ctx, client, repo, number, id, input); err != nil {
+			return err
+		}
+	}
+	if id == 0 {
+		logrus.Infof("creating summary comment on %s", key)
+		comment, _, err := client.PullRequests.CreateComment(ctx, repo, number, input)
+		if err != nil {
+			return err
+		}
+		id = comment.ID
+	}
+
+	c.lock.Lock()
+	c.comments[key] = id
+	c.bodies[key] = body
+	c.lock.Unlock()
+	return nil
+}
+
+// lockComment locks the summary comment of the pull request, returning the function that unlocks it.
+func (c *Commenter) lockComment(key string) func() {
+	c.lock.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &commentLock{}
+		c.locks[key] = l
+	}
+	l.refs++
+	c.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(c.locks, key)
+		}
+	}
+}
+
+// resources finds all pull request resources created for the pull request.
+func (c *Commenter) resources(ctx context.Context, gitURL string, branch string, number int) ([]Resource, error) {
+	var resources []Resource
+	for _, gvrk := range pullRequestKinds(c.cache) {
+		objs, err := c.cache.Lookup(ctx, gvrk, gitURL, branch)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			if n, ok := defines.PullRequestNumberOf(obj); ok && n == number && defines.IsManaged(obj) {
+				resources = append(resources, Resource{
+					Kind:      gvrk.Kind,
+					Namespace: obj.GetNamespace(),
+					Name:      obj.GetName(),
+					Phase:     Phase(obj),
+					URL:       URL(obj),
+				})
+			}
+		}
+	}
+	return resources, nil
+}
+
+// editComment edits the summary comment, returning its id. If the comment no longer exists the summary
+// comment is found again and edited instead, returning 0 if there isn't one.
+func editComment(ctx context.Context, client *scm.Client, repo string, number int, id int, input *scm.CommentInput) (int, error) {
+	_, res, err := client.PullRequests.EditComment(ctx, repo, number, id, input)
+	if !isNotFound(res, err) {
+		return id, err
+	}
+
+	logrus.Infof("summary comment %d on %s#%d no longer exists, finding it again", id, repo, number)
+	found, findErr := findComment(ctx, client, repo, number)
+	switch {
+	case findErr != nil:
+		return 0, findErr
+	case found == id:
+		return 0, err
+	case found == 0:
+		return 0, nil
+	}
+	_, _, err = client.PullRequests.EditComment(ctx, repo, number, found, input)
+	return found, err
+}
+
+func isNotFound(res *scm.Response, err error) bool {
+	return errors.Is(err, scm.ErrNotFound) || (err != nil && res != nil && res.Status == http.StatusNotFound)
+}
+
+// findComment finds the id of an existing summary comment written by the user of the token, returning 0
+// if there isn't one. Comments written by anyone else are ignored even if they contain the marker, as
+// they cannot be edited.
+func findComment(ctx context.Context, client *scm.Client, repo string, number int) (int, error) {
+	var user *scm.User
+	opts := &scm.ListOptions{Page: 1, Size: 100}
+	for {
+		comments, res, err := client.PullRequests.ListComments(ctx, repo, number, opts)
+		if err != nil {
+			return 0, err
+		}
+		for _, comment := range comments {
+			if !strings.Contains(comment.Body, CommentMarker) {
+				continue
+			}
+			// the user is only needed once a comment with the marker is found
+			if user == nil {
+				if user, _, err = client.Users.Find(ctx); err != nil {
+					return 0, fmt.Errorf("unable to find the user of the token: %w", err)
+				}
+			}
+			if user.Login != "" && strings.EqualFold(comment.Author.Login, user.Login) {
+				return comment.ID, nil
+			}
+		}
+		if res == nil || res.Page.Next == 0 {
+			return 0, nil
+		}
+		opts.Page = res.Page.Next
+	}
+}
+
+// Resource is a pull request resource listed in the summary comment.
+type Resource struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Phase     string
+	URL       string
+}
+
+// Summary renders the summary comment for the pull request resources.
+func Summary(resources []Resource) string {
+	sorted := make([]Resource, len(resources))
+	copy(sorted, resources)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Kind+"/"+sorted[i].Namespace+"/"+sorted[i].Name < sorted[j].Kind+"/"+sorted[j].Namespace+"/"+sorted[j].Name
+	})
+
+	var sb strings.Builder
+	sb.WriteString(CommentMarker + "\n")
+	sb.WriteString("### pr-controller\n\n")
+	if len(sorted) == 0 {
+		sb.WriteString("No resources have been created for this pull request.\n")
+		return sb.String()
+	}
+
+	sb.WriteString("| Kind | Namespace | Name | Phase | URL |\n")
+	sb.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, r := range sorted {
+		url := r.URL
+		if url == "" {
+			url = "-"
+		}
+		sb.WriteString(fmt.Sprintf("| %s | %s | %s | %s | %s |\n", r.Kind, r.Namespace, r.Name, r.Phase, url))
+	}
+	return sb.String()
+}
+
+// Phase determines the current phase of a resource, using status.phase if it is set or the Ready or
+// Succeeded condition otherwise.
+func Phase(obj *unstructured.Unstructured) string {
+	if phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase"); phase != "" {
+		return phase
+	}
+
+	state, _ := State(obj)
+	switch state {
+	case scm.StateSuccess:
+		return "Succeeded"
+	case scm.StateFailure:
+		return "Failed"
+	default:
+		if conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions"); len(conditions) > 0 {
+			return "Running"
+		}
+		return "Pending"
+	}
+}
+
+// URL finds the first http(s) url in the status of a resource, e.g. status.url or status.address.url.
+func URL(obj *unstructured.Unstructured) string {
+	status, _, _ := unstructured.NestedMap(obj.Object, "status")
+	return findURL(status)
+}
+
+func findURL(m map[string]interface{}) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// prefer urls at this level before looking in nested fields
+	for _, k := range keys {
+		if s, ok := m[k].(string); ok && strings.HasSuffix(strings.ToLower(k), "url") &&
+			(strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")) {
+			return s
+		}
+	}
+	for _, k := range keys {
+		if nested, ok := m[k].(map[string]interface{}); ok {
+			if url := findURL(nested); url != "" {
+				return url
+			}
+		}
+	}
+	return ""
+}
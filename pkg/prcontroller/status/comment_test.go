@@ -0,0 +1,417 @@
+package status_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/status"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestComment(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     string
+		wantRequests []string
+	}{
+		{
+			name:     "creates a new comment",
+			existing: `[{"id": 1, "body": "looks good"}]`,
+			wantRequests: []string{
+				"GET /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+				"POST /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+				"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+			},
+		},
+		{
+			name:     "edits the existing comment",
+			existing: `[{"id": 1, "body": "looks good"}, {"id": 7, "body": "` + status.CommentMarker + `\nold", "user": {"login": "pr-bot"}}]`,
+			wantRequests: []string{
+				"GET /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+				"GET /api/v3/user",
+				"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+				"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+			},
+		},
+		{
+			name:     "ignores a comment with the marker written by someone else",
+			existing: `[{"id": 1, "body": "` + status.CommentMarker + `", "user": {"login": "author"}}]`,
+			wantRequests: []string{
+				"GET /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+				"GET /api/v3/user",
+				"POST /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+				"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, requests := fakeSCMWithResponses(t, func(r *http.Request) (int, string) {
+				switch {
+				case r.URL.Path == "/api/v3/user":
+					return http.StatusOK, `{"login": "pr-bot"}`
+				case r.Method == http.MethodGet:
+					return http.StatusOK, tt.existing
+				case r.Method == http.MethodPost:
+					return http.StatusCreated, `{"id": 7}`
+				default:
+					return http.StatusOK, `{"id": 7}`
+				}
+			})
+			u, _ := url.Parse(s.URL)
+
+			scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+			t.Setenv("GITHUB_TOKEN", "token")
+
+			obj := pullRequestResource(s.URL+"/jenkins-x/go-scm.git", map[string]interface{}{
+				"type":   "Ready",
+				"status": "Unknown",
+			})
+
+			cache, d := newCache(t, nil, obj)
+			c := status.NewCommenter(cache)
+
+			if err := c.Comment(context.Background(), examplePullRequestGVRK, obj); err != nil {
+				t.Fatal(err)
+			}
+			// an unchanged comment is not updated
+			if err := c.Comment(context.Background(), examplePullRequestGVRK, obj); err != nil {
+				t.Fatal(err)
+			}
+
+			if body := lastBody(*requests); !strings.Contains(body, "| ExamplePullRequest | my-namespace | go-scm-pr-416 | Running | - |") {
+				t.Errorf("unexpected comment %s", body)
+			}
+
+			// the comment is edited in place when the status changes
+			updated := obj.DeepCopy()
+			_ = unstructured.SetNestedField(updated.Object, "https://go-scm.example.com", "status", "address", "url")
+			_ = unstructured.SetNestedField(updated.Object, "Succeeded", "status", "phase")
+			_, err := d.Resource(examplePullRequestGVRK.ToGroupVersionResource()).Namespace("my-namespace").Update(context.Background(), updated, v1.UpdateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for len(*requests) < len(tt.wantRequests) {
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for the comment to be updated")
+				}
+				if err := c.Comment(context.Background(), examplePullRequestGVRK, updated); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if body := lastBody(*requests); !strings.Contains(body, "| ExamplePullRequest | my-namespace | go-scm-pr-416 | Succeeded | https://go-scm.example.com |") {
+				t.Errorf("unexpected comment %s", body)
+			}
+
+			got := make([]string, 0, len(*requests))
+			for _, r := range *requests {
+				got = append(got, r.Method+" "+r.Path)
+			}
+			if !reflect.DeepEqual(got, tt.wantRequests) {
+				t.Errorf("requests = %v, want %v", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCommentConcurrentPullRequests(t *testing.T) {
+	listing := make(chan struct{}, 1)
+	blocked := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/issues/416/"):
+			// listing the comments of PR-416 doesn't respond until the test ends
+			listing <- struct{}{}
+			<-blocked
+			_, _ = w.Write([]byte(`[]`))
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id": 7}`))
+		default:
+			_, _ = w.Write([]byte(`[]`))
+		}
+	}))
+	defer s.Close()
+	defer close(blocked)
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	first := pullRequestResource(s.URL + "/jenkins-x/go-scm.git")
+	second := pullRequestResource(s.URL + "/jenkins-x/go-scm.git")
+	second.SetName("go-scm-pr-417")
+	second.SetLabels(map[string]string{defines.ManagedByLabel: defines.ManagedBy, defines.NumberLabel: "417"})
+
+	cache, _ := newCache(t, nil, first, second)
+	c := status.NewCommenter(cache)
+
+	go func() {
+		_ = c.Comment(context.Background(), examplePullRequestGVRK, first)
+	}()
+	select {
+	case <-listing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the comments of PR-416 to be listed")
+	}
+
+	// the comment on another pull request doesn't wait for the slow request
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Comment(context.Background(), examplePullRequestGVRK, second)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the comment on PR-417 waited for the comment on PR-416")
+	}
+}
+
+func TestCommentMappedKinds(t *testing.T) {
+	s, requests := fakeSCMWithResponses(t, func(r *http.Request) (int, string) {
+		if r.Method == http.MethodGet {
+			return http.StatusOK, `[]`
+		}
+		return http.StatusCreated, `{"id": 7}`
+	})
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	mapping := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pr.apps.tanzu.vmware.com/v1alpha1",
+		"kind":       "ClusterPullRequestMapping",
+		"metadata": map[string]interface{}{
+			"name": "previews",
+		},
+		"spec": map[string]interface{}{
+			"base":        map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Example"},
+			"pullRequest": map[string]interface{}{"apiVersion": "example.com/v1alpha1", "kind": "Preview"},
+			"template":    "spec: {}\n",
+		},
+	}}
+	preview := pullRequestResource(s.URL + "/jenkins-x/go-scm.git")
+	preview.SetKind("Preview")
+
+	cache, _ := newCache(t, nil, mapping, preview)
+	c := status.NewCommenter(cache)
+
+	if err := c.Comment(context.Background(), previewGVRK, preview); err != nil {
+		t.Fatal(err)
+	}
+	if body := lastBody(*requests); !strings.Contains(body, "| Preview | my-namespace | go-scm-pr-416 | Pending | - |") {
+		t.Errorf("unexpected comment %s", body)
+	}
+}
+
+func TestCommentSourceLayout(t *testing.T) {
+	s, requests := fakeSCMWithResponses(t, func(r *http.Request) (int, string) {
+		if r.Method == http.MethodGet {
+			return http.StatusOK, `[]`
+		}
+		return http.StatusCreated, `{"id": 7}`
+	})
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	// the source is read with the layout of the supply chain, not from the git fields that happen to be set
+	obj := pullRequestResource(s.URL + "/jenkins-x/config.git")
+	obj.Object["spec"].(map[string]interface{})["url"] = s.URL + "/jenkins-x/go-scm.git"
+	obj.Object["spec"].(map[string]interface{})["ref"] = map[string]interface{}{"branch": "feature", "commit": sha}
+
+	cache, _ := newCache(t, map[string]interface{}{defines.SourceLayoutAnnotation: defines.SourceLayoutFlux}, obj)
+	c := status.NewCommenter(cache)
+
+	if err := c.Comment(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) == 0 || (*requests)[len(*requests)-1].Path != "/api/v3/repos/jenkins-x/go-scm/issues/416/comments" {
+		t.Errorf("requests = %+v, want a comment on jenkins-x/go-scm", *requests)
+	}
+	if body := lastBody(*requests); !strings.Contains(body, "| ExamplePullRequest | my-namespace | go-scm-pr-416 | Pending | - |") {
+		t.Errorf("unexpected comment %s", body)
+	}
+}
+
+func TestCommentDeleted(t *testing.T) {
+	s, requests := fakeSCMWithResponses(t, func(r *http.Request) (int, string) {
+		if r.Method == http.MethodGet {
+			return http.StatusOK, `[]`
+		}
+		return http.StatusCreated, `{"id": 7}`
+	})
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	obj := pullRequestResource(s.URL + "/jenkins-x/go-scm.git")
+	other := pullRequestResource(s.URL + "/jenkins-x/go-scm.git")
+	other.SetName("other-pr-416")
+	cache, d := newCache(t, nil, obj, other)
+	c := status.NewCommenter(cache)
+
+	if err := c.Comment(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	// the summary lists the resources that remain after each is deleted
+	for _, deleted := range []*unstructured.Unstructured{obj, other} {
+		prs := d.Resource(examplePullRequestGVRK.ToGroupVersionResource()).Namespace("my-namespace")
+		if err := prs.Delete(context.Background(), deleted.GetName(), v1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, exists, _ := cache.Get(context.Background(), examplePullRequestGVRK, "my-namespace", deleted.GetName()); !exists {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s to be deleted", deleted.GetName())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := c.Comment(context.Background(), examplePullRequestGVRK, deleted); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make([]string, 0, len(*requests))
+	for _, r := range *requests {
+		got = append(got, r.Method+" "+r.Path)
+	}
+	want := []string{
+		"GET /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+		"POST /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+		"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+		"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests = %v, want %v", got, want)
+	}
+
+	if body, _ := (*requests)[2].Body["body"].(string); strings.Contains(body, "go-scm-pr-416") || !strings.Contains(body, "other-pr-416") {
+		t.Errorf("unexpected comment after go-scm-pr-416 was deleted %s", body)
+	}
+	if body := lastBody(*requests); !strings.Contains(body, "No resources have been created for this pull request.") {
+		t.Errorf("unexpected comment after every resource was deleted %s", body)
+	}
+}
+
+func TestCommentRemoved(t *testing.T) {
+	var removed atomic.Bool
+	s, requests := fakeSCMWithResponses(t, func(r *http.Request) (int, string) {
+		switch {
+		case r.URL.Path == "/api/v3/user":
+			return http.StatusOK, `{"login": "pr-bot"}`
+		case r.Method == http.MethodGet && removed.Load():
+			return http.StatusOK, `[{"id": 8, "body": "` + status.CommentMarker + `", "user": {"login": "pr-bot"}}]`
+		case r.Method == http.MethodGet:
+			return http.StatusOK, `[]`
+		case r.Method == http.MethodPost:
+			return http.StatusCreated, `{"id": 7}`
+		case strings.HasSuffix(r.URL.Path, "/7") && removed.Load():
+			return http.StatusNotFound, `{"message": "Not Found"}`
+		default:
+			return http.StatusOK, `{"id": 8}`
+		}
+	})
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	obj := pullRequestResource(s.URL + "/jenkins-x/go-scm.git")
+	cache, d := newCache(t, nil, obj)
+	c := status.NewCommenter(cache)
+
+	if err := c.Comment(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	// the comment was replaced, so the cached id is dropped and the summary comment found again
+	removed.Store(true)
+	updated := obj.DeepCopy()
+	_ = unstructured.SetNestedField(updated.Object, "Succeeded", "status", "phase")
+	if _, err := d.Resource(examplePullRequestGVRK.ToGroupVersionResource()).Namespace("my-namespace").Update(context.Background(), updated, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _, _ := cache.Get(context.Background(), examplePullRequestGVRK, "my-namespace", obj.GetName()); status.Phase(got) == "Succeeded" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the resource to be updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Comment(context.Background(), examplePullRequestGVRK, updated); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(*requests))
+	for _, r := range *requests {
+		got = append(got, r.Method+" "+r.Path)
+	}
+	want := []string{
+		"GET /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+		"POST /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+		"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/7",
+		"GET /api/v3/repos/jenkins-x/go-scm/issues/416/comments",
+		"GET /api/v3/user",
+		"PATCH /api/v3/repos/jenkins-x/go-scm/issues/comments/8",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests = %v, want %v", got, want)
+	}
+}
+
+func lastBody(requests []request) string {
+	if len(requests) == 0 {
+		return ""
+	}
+	body, _ := requests[len(requests)-1].Body["body"].(string)
+	return body
+}
+
+func TestSummary(t *testing.T) {
+	got := status.Summary([]status.Resource{
+		{Kind: "ExamplePullRequest", Namespace: "ns-2", Name: "go-scm-pr-1", Phase: "Failed"},
+		{Kind: "ExamplePullRequest", Namespace: "ns-1", Name: "go-scm-pr-1", Phase: "Succeeded", URL: "https://go-scm.example.com"},
+	})
+
+	want := status.CommentMarker + `
+### pr-controller
+
+| Kind | Namespace | Name | Phase | URL |
+| --- | --- | --- | --- | --- |
+| ExamplePullRequest | ns-1 | go-scm-pr-1 | Succeeded | https://go-scm.example.com |
+| ExamplePullRequest | ns-2 | go-scm-pr-1 | Failed | - |
+`
+	if got != want {
+		t.Errorf("Summary() = %s, want %s", got, want)
+	}
+}
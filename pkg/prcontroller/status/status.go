@@ -0,0 +1,223 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// maxDescriptionLength is the longest description GitHub accepts for a commit status.
+const maxDescriptionLength = 140
+
+// Reporter watches pull request resources and reports their status back to the SCM as commit
+// statuses on the commit they were created for.
+type Reporter struct {
+	cache *cache.Cache
+
+	lock sync.Mutex
+	// reported is the last status reported for each resource, so statuses are only posted when they change.
+	reported map[string]scm.StatusInput
+}
+
+// NewReporter creates a new Reporter.
+func NewReporter(c *cache.Cache) *Reporter {
+	return &Reporter{
+		cache:    c,
+		reported: make(map[string]scm.StatusInput),
+	}
+}
+
+// Start reports the status of pull request resources whenever they change, from workers that stop
+// when the context is done.
+func (r *Reporter) Start(ctx context.Context, workers int) {
+	q := newWorkQueue("statuses", func(ctx context.Context, item interface{}) error {
+		key, ok := item.(resourceKey)
+		if !ok {
+			return nil
+		}
+		obj, exists, err := r.cache.Get(ctx, key.gvrk, key.namespace, key.name)
+		if err != nil || !exists {
+			return err
+		}
+		return r.Report(ctx, key.gvrk, obj)
+	})
+
+	r.cache.OnChange(func(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) {
+		if isPullRequestKind(r.cache, gvrk) {
+			q.add(keyOf(gvrk, obj))
+		}
+	})
+	r.cache.OnDelete(func(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) {
+		if isPullRequestKind(r.cache, gvrk) {
+			r.Forget(gvrk, obj)
+		}
+	})
+	q.start(ctx, workers)
+}
+
+// Report posts the status of a pull request resource as a commit status.
+func (r *Reporter) Report(ctx context.Context, gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) error {
+	if !defines.IsManaged(obj) {
+		return nil
+	}
+
+	source := r.cache.Options(gvrk).Source().Read(obj)
+	gitURL := source.URL
+	sha := obj.GetAnnotations()[defines.ShaAnnotation]
+	if sha == "" {
+		sha = source.Commit
+	}
+	if gitURL == "" || sha == "" {
+		return nil
+	}
+
+	state, desc := State(obj)
+	input := scm.StatusInput{
+		State: state,
+		Label: r.context(gvrk),
+		Desc:  desc,
+	}
+
+	key := reportedKey(gvrk, obj) + sha
+
+	r.lock.Lock()
+	last, ok := r.reported[key]
+	r.lock.Unlock()
+	if ok && last == input {
+		return nil
+	}
+
+	client, repo, err := scmclient.ForURL(gitURL)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("reporting %s status for %s %s/%s on %s@%s", state, gvrk.Kind, obj.GetNamespace(), obj.GetName(), repo, sha)
+	_, _, err = client.Repositories.CreateStatus(ctx, repo, sha, &input)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.reported[key] = input
+	r.lock.Unlock()
+
+	return nil
+}
+
+// Forget forgets the statuses reported for a pull request resource that has been deleted.
+func (r *Reporter) Forget(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) {
+	prefix := reportedKey(gvrk, obj)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key := range r.reported {
+		if strings.HasPrefix(key, prefix) {
+			delete(r.reported, key)
+		}
+	}
+}
+
+// reportedKey is the prefix of the keys of the statuses reported for a resource, which are followed by the sha.
+func reportedKey(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s/%s/%s@", gvrk.Kind, obj.GetNamespace(), obj.GetName())
+}
+
+// pullRequestKinds returns the pull request kinds, those named after their base kind and those created
+// by a mapping, whatever they are named.
+func pullRequestKinds(c *cache.Cache) []defines.GroupVersionResourceKind {
+	var kinds []defines.GroupVersionResourceKind
+	for _, k := range c.Kinds() {
+		if k.IsPullRequest() {
+			kinds = append(kinds, k)
+		}
+	}
+	for _, m := range c.Mappings() {
+		if !containsKind(kinds, m.PullRequest) {
+			kinds = append(kinds, m.PullRequest)
+		}
+	}
+	return kinds
+}
+
+func isPullRequestKind(c *cache.Cache, gvrk defines.GroupVersionResourceKind) bool {
+	return containsKind(pullRequestKinds(c), gvrk)
+}
+
+func containsKind(kinds []defines.GroupVersionResourceKind, gvrk defines.GroupVersionResourceKind) bool {
+	for _, k := range kinds {
+		if k == gvrk {
+			return true
+		}
+	}
+	return false
+}
+
+// context is the context of the commit status, either configured on the supply chain or derived from the kind.
+func (r *Reporter) context(gvrk defines.GroupVersionResourceKind) string {
+	if c := r.cache.Options(gvrk).StatusContext; c != "" {
+		return c
+	}
+	return "pr-controller/" + strings.ToLower(gvrk.Kind)
+}
+
+// State determines the commit status from the Ready or Succeeded condition of a resource.
+func State(obj *unstructured.Unstructured) (scm.State, string) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	for _, conditionType := range []string{"Ready", "Succeeded"} {
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if !ok || condition["type"] != conditionType {
+				continue
+			}
+
+			status, _ := condition["status"].(string)
+			desc, _ := condition["message"].(string)
+			if desc == "" {
+				desc, _ = condition["reason"].(string)
+			}
+
+			switch status {
+			case "True":
+				return scm.StateSuccess, truncate(orDefault(desc, "Succeeded"))
+			case "False":
+				return scm.StateFailure, truncate(orDefault(desc, "Failed"))
+			default:
+				return scm.StatePending, truncate(orDefault(desc, "Running"))
+			}
+		}
+	}
+
+	return scm.StatePending, "Waiting for status"
+}
+
+func orDefault(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// truncate shortens the description to maxDescriptionLength bytes, cutting it at the start of a rune
+// so that it remains valid UTF-8.
+func truncate(s string) string {
+	if len(s) <= maxDescriptionLength {
+		return s
+	}
+	i := maxDescriptionLength - 3
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i] + "..."
+}
@@ -0,0 +1,374 @@
+package status_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/cache"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/status"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+)
+
+const sha = "8684159e92a02bba44a66363603b6956045ef219"
+
+var examplePullRequestGVRK = defines.GroupVersionResourceKind{
+	Group:    "example.com",
+	Version:  "v1alpha1",
+	Resource: "examplepullrequests",
+	Kind:     "ExamplePullRequest",
+}
+
+var previewGVRK = defines.GroupVersionResourceKind{
+	Group:    "example.com",
+	Version:  "v1alpha1",
+	Resource: "previews",
+	Kind:     "Preview",
+}
+
+type request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   map[string]interface{}
+}
+
+// fakeSCM records the requests made to it, responding as GitHub or GitLab would when creating statuses.
+func fakeSCM(t *testing.T) (*httptest.Server, *[]request) {
+	return fakeSCMWithResponses(t, func(r *http.Request) (int, string) {
+		if r.Method == http.MethodGet {
+			// gitlab looks up the project before creating a status
+			return http.StatusOK, `{"id": 42, "path_with_namespace": "jenkins-x/go-scm"}`
+		}
+		return http.StatusCreated, `{}`
+	})
+}
+
+// fakeSCMWithResponses records the requests made to it, responding with the given function.
+func fakeSCMWithResponses(t *testing.T, respond func(r *http.Request) (int, string)) (*httptest.Server, *[]request) {
+	var requests []request
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{Method: r.Method, Path: r.URL.EscapedPath(), Query: r.URL.Query()}
+		b, _ := io.ReadAll(r.Body)
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &req.Body); err != nil {
+				t.Errorf("unable to parse request body: %v", err)
+			}
+		}
+		requests = append(requests, req)
+
+		code, body := respond(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s, &requests
+}
+
+func newCache(t *testing.T, annotations map[string]interface{}, objects ...runtime.Object) (*cache.Cache, dynamic.Interface) {
+	client := kubernetesfake.NewSimpleClientset()
+	fakeDiscovery, ok := client.Discovery().(*discoveryfake.FakeDiscovery)
+	if !ok {
+		t.Fatalf("couldn't convert Discovery() to *FakeDiscovery")
+	}
+	fakeDiscovery.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "example.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "examples", SingularName: "example", Namespaced: true, Kind: "Example"},
+				{Name: "examplepullrequests", SingularName: "examplepullrequest", Namespaced: true, Kind: "ExamplePullRequest"},
+				{Name: "previews", SingularName: "preview", Namespaced: true, Kind: "Preview"},
+			},
+		},
+		{
+			GroupVersion: "pr.apps.tanzu.vmware.com/v1alpha1",
+			APIResources: []v1.APIResource{
+				{Name: "pullrequestmappings", SingularName: "pullrequestmapping", Namespaced: true, Kind: "PullRequestMapping"},
+				{Name: "clusterpullrequestmappings", SingularName: "clusterpullrequestmapping", Namespaced: false, Kind: "ClusterPullRequestMapping"},
+			},
+		},
+	}
+
+	objects = append(objects,
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "supply-chain.apps.tanzu.vmware.com/v1alpha1",
+			"kind":       "SupplyChain",
+			"metadata": map[string]interface{}{
+				"name":        "example-prs",
+				"annotations": annotations,
+			},
+			"spec": map[string]interface{}{
+				"defines": map[string]interface{}{
+					"group":   "example.com",
+					"version": "v1alpha1",
+					"kind":    "ExamplePullRequest",
+				},
+			},
+		}},
+	)
+
+	d := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			cache.SupplyChainGVR:                            "SupplyChainList",
+			examplePullRequestGVRK.ToGroupVersionResource(): "ExamplePullRequestList",
+			previewGVRK.ToGroupVersionResource():            "PreviewList",
+			{Group: "pr.apps.tanzu.vmware.com", Version: "v1alpha1", Resource: "pullrequestmappings"}:        "PullRequestMappingList",
+			{Group: "pr.apps.tanzu.vmware.com", Version: "v1alpha1", Resource: "clusterpullrequestmappings"}: "ClusterPullRequestMappingList",
+		},
+		objects...,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	c := cache.New(d, defines.NewMapper(fakeDiscovery), time.Minute)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c, d
+}
+
+func pullRequestResource(gitURL string, conditions ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1alpha1",
+		"kind":       "ExamplePullRequest",
+		"metadata": map[string]interface{}{
+			"name":      "go-scm-pr-416",
+			"namespace": "my-namespace",
+			"labels": map[string]interface{}{
+				defines.ManagedByLabel: defines.ManagedBy,
+				defines.NumberLabel:    "416",
+			},
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{
+				"git": map[string]interface{}{
+					"url":    gitURL,
+					"branch": "feature",
+					"commit": sha,
+				},
+			},
+		},
+		"status": map[string]interface{}{
+			"conditions": conditions,
+		},
+	}}
+}
+
+func TestReportGitHub(t *testing.T) {
+	s, requests := fakeSCM(t)
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	c, _ := newCache(t, map[string]interface{}{defines.StatusContextAnnotation: "carvel/pr"})
+	r := status.NewReporter(c)
+
+	obj := pullRequestResource(s.URL+"/jenkins-x/go-scm.git", map[string]interface{}{
+		"type":    "Ready",
+		"status":  "True",
+		"message": "all good",
+	})
+
+	if err := r.Report(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+	// an unchanged status is only reported once
+	if err := r.Report(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 1 {
+		t.Fatalf("expected 1 request, got %d: %+v", len(*requests), *requests)
+	}
+
+	got := (*requests)[0]
+	if got.Path != "/api/v3/repos/jenkins-x/go-scm/statuses/"+sha {
+		t.Errorf("unexpected path %s", got.Path)
+	}
+	if got.Body["state"] != "success" || got.Body["context"] != "carvel/pr" || got.Body["description"] != "all good" {
+		t.Errorf("unexpected body %v", got.Body)
+	}
+}
+
+func TestReporterStart(t *testing.T) {
+	release := make(chan struct{})
+	posted := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the SCM is slow, which must not hold up the cache's other event handlers
+		<-release
+		posted <- r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(s.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	c, d := newCache(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	status.NewReporter(c).Start(ctx, 1)
+
+	changed := make(chan struct{}, 10)
+	c.OnChange(func(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) {
+		if gvrk == examplePullRequestGVRK {
+			changed <- struct{}{}
+		}
+	})
+
+	obj := pullRequestResource(s.URL+"/jenkins-x/go-scm.git", map[string]interface{}{
+		"type":   "Ready",
+		"status": "True",
+	})
+	if _, err := d.Resource(examplePullRequestGVRK.ToGroupVersionResource()).Namespace("my-namespace").Create(ctx, obj, v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cache's event handlers were blocked by the status being reported")
+	}
+
+	close(release)
+	select {
+	case path := <-posted:
+		if path != "/api/v3/repos/jenkins-x/go-scm/statuses/"+sha {
+			t.Errorf("unexpected path %s", path)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the status to be reported")
+	}
+}
+
+func TestReportForget(t *testing.T) {
+	s, requests := fakeSCM(t)
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "github"))
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	c, _ := newCache(t, nil)
+	r := status.NewReporter(c)
+
+	obj := pullRequestResource(s.URL+"/jenkins-x/go-scm.git", map[string]interface{}{
+		"type":   "Ready",
+		"status": "True",
+	})
+
+	if err := r.Report(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+	// a resource recreated after it was deleted has its status reported again
+	r.Forget(examplePullRequestGVRK, obj)
+	if err := r.Report(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d: %+v", len(*requests), *requests)
+	}
+}
+
+func TestReportGitLab(t *testing.T) {
+	s, requests := fakeSCM(t)
+	u, _ := url.Parse(s.URL)
+
+	scmclient.Identifier = factory.NewDriverIdentifier(factory.Mapping(u.Host, "gitlab"))
+	t.Setenv("GITLAB_TOKEN", "token")
+
+	c, _ := newCache(t, nil)
+	r := status.NewReporter(c)
+
+	obj := pullRequestResource(s.URL+"/jenkins-x/go-scm.git", map[string]interface{}{
+		"type":   "Succeeded",
+		"status": "False",
+		"reason": "TestsFailed",
+	})
+
+	if err := r.Report(context.Background(), examplePullRequestGVRK, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d: %+v", len(*requests), *requests)
+	}
+
+	got := (*requests)[1]
+	if got.Path != "/api/v4/projects/42/statuses/"+sha {
+		t.Errorf("unexpected path %s", got.Path)
+	}
+	if got.Query.Get("state") != "failed" || got.Query.Get("name") != "pr-controller/examplepullrequest" || got.Query.Get("description") != "TestsFailed" {
+		t.Errorf("unexpected query %v", got.Query)
+	}
+}
+
+func TestState(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []interface{}
+		want       scm.State
+		wantDesc   string
+	}{
+		{
+			name: "no conditions",
+			want: scm.StatePending, wantDesc: "Waiting for status",
+		},
+		{
+			name:       "ready unknown",
+			conditions: []interface{}{map[string]interface{}{"type": "Ready", "status": "Unknown"}},
+			want:       scm.StatePending, wantDesc: "Running",
+		},
+		{
+			name: "ready preferred over succeeded",
+			conditions: []interface{}{
+				map[string]interface{}{"type": "Succeeded", "status": "False"},
+				map[string]interface{}{"type": "Ready", "status": "True"},
+			},
+			want: scm.StateSuccess, wantDesc: "Succeeded",
+		},
+		{
+			name:       "long message truncated between runes",
+			conditions: []interface{}{map[string]interface{}{"type": "Ready", "status": "False", "message": strings.Repeat("é", 100)}},
+			want:       scm.StateFailure, wantDesc: strings.Repeat("é", 68) + "...",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, desc := status.State(pullRequestResource("https://github.com/jenkins-x/go-scm", tt.conditions...))
+			if got != tt.want || desc != tt.wantDesc {
+				t.Errorf("State() = %v, %q, want %v, %q", got, desc, tt.want, tt.wantDesc)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garethjevans/pr-controller/pkg/defines"
+	"github.com/garethjevans/pr-controller/pkg/prcontroller/scmclient"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DefaultWorkers is the default number of workers making the SCM calls of a Reporter or Commenter.
+const DefaultWorkers = 2
+
+// maxRetries is the number of times a failed SCM call is retried.
+const maxRetries = 12
+
+// retryDelay and maxRetryDelay are the first and longest delays before retrying a failed SCM call, so
+// that calls are retried for over 20 minutes and outlast transient SCM failures.
+const (
+	retryDelay    = time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// callTimeout is how long the SCM calls for a single item may take.
+const callTimeout = 30 * time.Second
+
+// workQueue is a rate limited work queue whose workers make the SCM calls, so that they are not made
+// by the cache's event handlers. Items that change again while they are queued are handled once.
+type workQueue struct {
+	name   string
+	queue  workqueue.RateLimitingInterface
+	handle func(ctx context.Context, item interface{}) error
+}
+
+func newWorkQueue(name string, handle func(ctx context.Context, item interface{}) error) *workQueue {
+	return &workQueue{
+		name: name,
+		queue: workqueue.NewRateLimitingQueueWithConfig(workqueue.NewItemExponentialFailureRateLimiter(retryDelay, maxRetryDelay), workqueue.RateLimitingQueueConfig{
+			Name: name,
+		}),
+		handle: handle,
+	}
+}
+
+// add queues the item.
+func (q *workQueue) add(item interface{}) {
+	q.queue.Add(item)
+}
+
+// start starts the workers, which stop when the context is done.
+func (q *workQueue) start(ctx context.Context, workers int) {
+	go func() {
+		<-ctx.Done()
+		q.queue.ShutDown()
+	}()
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			for q.processNext(ctx) {
+			}
+		}, time.Second)
+	}
+}
+
+// processNext handles the next item, returning false when the queue has been shut down.
+func (q *workQueue) processNext(ctx context.Context) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	err := q.handle(ctx, item)
+	switch {
+	case err == nil:
+		q.queue.Forget(item)
+	case errors.Is(err, scmclient.ErrNoToken):
+		logrus.Debugf("%s: not handling %v: %v", q.name, item, err)
+		q.queue.Forget(item)
+	case q.queue.NumRequeues(item) < maxRetries:
+		logrus.Warnf("%s: unable to handle %v, retrying: %v", q.name, item, err)
+		q.queue.AddRateLimited(item)
+	default:
+		logrus.Errorf("%s: unable to handle %v, dropping it after %d retries: %v", q.name, item, maxRetries, err)
+		q.queue.Forget(item)
+	}
+	return true
+}
+
+// resourceKey is a queued pull request resource, which is read from the cache when it is handled so
+// that the latest version is used.
+type resourceKey struct {
+	gvrk      defines.GroupVersionResourceKind
+	namespace string
+	name      string
+}
+
+func keyOf(gvrk defines.GroupVersionResourceKind, obj *unstructured.Unstructured) resourceKey {
+	return resourceKey{gvrk: gvrk, namespace: obj.GetNamespace(), name: obj.GetName()}
+}
+
+func (k resourceKey) String() string {
+	return fmt.Sprintf("%s %s/%s", k.gvrk.Kind, k.namespace, k.name)
+}